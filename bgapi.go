@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// jobSession runs api commands as bgapi jobs over a single connection, so
+// that many of them can be in flight at once. FreeSWITCH acknowledges each
+// job with a command/reply, in the order they were sent, and delivers its
+// result later as a BACKGROUND_JOB event tagged with the Job-UUID we chose.
+type jobSession struct {
+	client *eslClient
+
+	writeMutex sync.Mutex
+
+	mutex   sync.Mutex
+	replies []*pendingReply        // in the order the commands were sent
+	jobs    map[string]chan []byte // by Job-UUID
+	err     error                  // why the session ended, once it did
+	done    chan struct{}
+}
+
+// errJobsUnavailable is returned by collectConcurrently when the connection
+// cannot run bgapi jobs, the collectors have to be run sequentially.
+var errJobsUnavailable = errors.New("bgapi jobs unavailable")
+
+type pendingReply struct {
+	reply chan string
+	last  bool // the session ends with this reply
+}
+
+// startJobSession subscribes to BACKGROUND_JOB events and starts reading the
+// connection, which belongs to the session until stop returns.
+func startJobSession(ctx context.Context, client *eslClient) (*jobSession, error) {
+	if _, err := client.command(ctx, "event json BACKGROUND_JOB"); err != nil {
+		return nil, err
+	}
+	client.conn.SetDeadline(time.Time{})
+
+	s := &jobSession{
+		client: client,
+		jobs:   make(map[string]chan []byte),
+		done:   make(chan struct{}),
+	}
+	go s.read()
+	return s, nil
+}
+
+func (s *jobSession) read() {
+	defer close(s.done)
+
+	for {
+		frame, err := s.client.readFrame()
+		if err != nil {
+			s.fail(fmt.Errorf("cannot read job session: %w", err))
+			return
+		}
+
+		switch frame.contentType() {
+		case "command/reply":
+			s.mutex.Lock()
+			if len(s.replies) == 0 {
+				s.mutex.Unlock()
+				s.fail(fmt.Errorf("%w: unexpected command/reply", ErrMalformedFrame))
+				return
+			}
+			pending := s.replies[0]
+			s.replies = s.replies[1:]
+			s.mutex.Unlock()
+
+			pending.reply <- frame.header.Get("Reply-Text")
+			if pending.last {
+				return
+			}
+		case "text/event-json":
+			event, err := parseEvent(frame.body)
+			if err != nil {
+				s.fail(err)
+				return
+			}
+			if event["Event-Name"] != "BACKGROUND_JOB" {
+				continue
+			}
+			s.mutex.Lock()
+			if result, ok := s.jobs[event["Job-UUID"]]; ok {
+				result <- []byte(event["_body"])
+				delete(s.jobs, event["Job-UUID"])
+			}
+			s.mutex.Unlock()
+		case "text/disconnect-notice":
+			s.fail(fmt.Errorf("%w: %s", ErrDisconnected, strings.TrimSpace(string(frame.body))))
+			return
+		}
+	}
+}
+
+// fail ends the session, every pending and later command returns err.
+func (s *jobSession) fail(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	for _, pending := range s.replies {
+		close(pending.reply)
+	}
+	s.replies = nil
+	for uuid, result := range s.jobs {
+		close(result)
+		delete(s.jobs, uuid)
+	}
+}
+
+// send writes command and registers for its reply, and for the result of
+// job if it is not empty.
+func (s *jobSession) send(ctx context.Context, command, job string, last bool) (*pendingReply, chan []byte, error) {
+	// writes are serialized apart from the state, which the reader needs
+	// to make progress while a write blocks
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	pending := &pendingReply{reply: make(chan string, 1), last: last}
+	var result chan []byte
+
+	s.mutex.Lock()
+	if s.err != nil {
+		s.mutex.Unlock()
+		return nil, nil, s.err
+	}
+	s.replies = append(s.replies, pending)
+	if job != "" {
+		result = make(chan []byte, 1)
+		s.jobs[job] = result
+	}
+	s.mutex.Unlock()
+
+	deadline, _ := ctx.Deadline()
+	s.client.conn.SetWriteDeadline(deadline)
+	if _, err := io.WriteString(s.client.conn, command+"\n\n"); err != nil {
+		err = fmt.Errorf("cannot write command: %w", contextError(ctx, readError(err)))
+		s.fail(err)
+		return nil, nil, err
+	}
+	return pending, result, nil
+}
+
+func (s *jobSession) wait(ctx context.Context, pending *pendingReply) (string, error) {
+	select {
+	case reply, ok := <-pending.reply:
+		if !ok {
+			return "", s.sessionError()
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (s *jobSession) sessionError() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err
+}
+
+// run executes an api command as a background job and returns its result.
+func (s *jobSession) run(ctx context.Context, command string) ([]byte, error) {
+	args, ok := strings.CutPrefix(command, "api ")
+	if !ok {
+		return nil, fmt.Errorf("cannot run %q as background job", command)
+	}
+
+	job := newJobUUID()
+	pending, result, err := s.send(ctx, fmt.Sprintf("bgapi %s\nJob-UUID: %s", args, job), job, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		s.mutex.Lock()
+		delete(s.jobs, job)
+		s.mutex.Unlock()
+	}()
+
+	reply, err := s.wait(ctx, pending)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(reply, "-ERR") {
+		if s.client.record != nil {
+			s.client.record(command, &eslFrame{header: textproto.MIMEHeader{
+				"Content-Type": {"command/reply"},
+				"Reply-Text":   {reply},
+			}})
+		}
+		return nil, newReplyError(command, reply)
+	}
+
+	select {
+	case body, ok := <-result:
+		if !ok {
+			return nil, s.sessionError()
+		}
+		// recorded as if the command ran in the foreground
+		if s.client.record != nil {
+			s.client.record(command, &eslFrame{
+				header: textproto.MIMEHeader{"Content-Type": {"api/response"}},
+				body:   body,
+			})
+		}
+		if strings.HasPrefix(string(body), "-ERR") {
+			return nil, newReplyError(command, string(body))
+		}
+		return body, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// stop unsubscribes from events and hands the connection back. Results of
+// abandoned jobs may still arrive afterwards, they are skipped as any event.
+func (s *jobSession) stop(ctx context.Context) error {
+	pending, _, err := s.send(ctx, "noevents", "", true)
+	if err != nil {
+		return err
+	}
+	if _, err = s.wait(ctx, pending); err != nil {
+		return err
+	}
+	<-s.done
+	return nil
+}
+
+func newJobUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// collectConcurrently runs all collectors at once, their commands being sent
+// as background jobs, so the scrape takes as long as the slowest of them.
+func (c *Collector) collectConcurrently(ctx context.Context, ch chan<- prometheus.Metric) error {
+	jobs, err := startJobSession(ctx, c.client)
+	if err != nil {
+		// a user not allowed to receive BACKGROUND_JOB events can still
+		// run the commands one after another
+		if !isConnectionError(err) {
+			level.Warn(c.logger).Log("msg", "bgapi unavailable, running the collectors sequentially", "err", err)
+			c.jobsUnavailable = true
+			return errJobsUnavailable
+		}
+		return err
+	}
+	c.jobs = jobs
+	defer func() {
+		c.jobs = nil
+	}()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(collectors))
+	for i := range collectors {
+		if _, ok := c.disables[collectors[i].name]; ok {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = c.collect(ctx, &collectors[i], ch)
+		}(i)
+	}
+	wg.Wait()
+
+	// the session has to end in any case, for the connection to be reused
+	return errors.Join(errors.Join(errs...), jobs.stop(ctx))
+}
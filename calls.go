@@ -0,0 +1,254 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// callLabels are the labels of the metrics kept from the hangup of a channel.
+var callLabels = []string{"direction", "profile", "gateway"}
+
+// callLabelValues returns the values of callLabels for the channel of event.
+func callLabelValues(event eslEvent) []string {
+	return []string{event["Call-Direction"], event["variable_sofia_profile_name"], gatewayName(event)}
+}
+
+// gatewayName returns the gateway of an outbound SIP channel, from its
+// variables or else from its name, e.g. sofia/gateway/carrier/15551230000.
+func gatewayName(event eslEvent) string {
+	if name := event["variable_sip_gateway_name"]; name != "" {
+		return name
+	}
+	if rest, ok := strings.CutPrefix(event["Channel-Name"], "sofia/gateway/"); ok {
+		name, _, _ := strings.Cut(rest, "/")
+		return name
+	}
+	return ""
+}
+
+// outboundGateway returns the gateway of an outbound channel, or "" for the
+// other channels.
+func outboundGateway(event eslEvent) string {
+	if event["Call-Direction"] != "outbound" {
+		return ""
+	}
+	return gatewayName(event)
+}
+
+// answered reports whether the channel of a hangup event was answered.
+func answered(event eslEvent) bool {
+	epoch := event["variable_answer_epoch"]
+	return epoch != "" && epoch != "0"
+}
+
+// seconds returns the value of an event header holding a number of seconds,
+// or milliseconds with scale 1000.
+func seconds(event eslEvent, header string, scale float64) (float64, bool) {
+	value, err := strconv.ParseFloat(event[header], 64)
+	if err != nil {
+		return 0, false
+	}
+	return value / scale, true
+}
+
+// hangupHandler counts the channels hung up by hangup cause.
+type hangupHandler struct {
+	hangups *prometheus.CounterVec
+}
+
+func newHangupHandler(_ *eventConfig) eventHandler {
+	return &hangupHandler{
+		hangups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "hangup_total",
+			Help:      "Number of channels hung up, by hangup cause.",
+		}, append([]string{"cause"}, callLabels...)),
+	}
+}
+
+func (h *hangupHandler) subscriptions() []string {
+	return []string{"CHANNEL_HANGUP_COMPLETE"}
+}
+
+func (h *hangupHandler) handle(event eslEvent) {
+	h.hangups.WithLabelValues(append([]string{event["Hangup-Cause"]}, callLabelValues(event)...)...).Inc()
+}
+
+func (h *hangupHandler) Describe(ch chan<- *prometheus.Desc) {
+	h.hangups.Describe(ch)
+}
+
+func (h *hangupHandler) Collect(ch chan<- prometheus.Metric) {
+	h.hangups.Collect(ch)
+}
+
+// durationHandler keeps the distribution of call lengths.
+type durationHandler struct {
+	duration *prometheus.HistogramVec
+	billsec  *prometheus.HistogramVec
+}
+
+func newDurationHandler(cfg *eventConfig) eventHandler {
+	return &durationHandler{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "call_duration_seconds",
+			Help:      "Total duration of the channels hung up, from creation to hangup.",
+			Buckets:   cfg.durationBuckets,
+		}, callLabels),
+		billsec: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "call_billable_seconds",
+			Help:      "Billable duration of the answered channels hung up, from answer to hangup.",
+			Buckets:   cfg.durationBuckets,
+		}, callLabels),
+	}
+}
+
+func (h *durationHandler) subscriptions() []string {
+	return []string{"CHANNEL_HANGUP_COMPLETE"}
+}
+
+func (h *durationHandler) handle(event eslEvent) {
+	labels := callLabelValues(event)
+	if duration, ok := seconds(event, "variable_duration", 1); ok {
+		h.duration.WithLabelValues(labels...).Observe(duration)
+	}
+	if billsec, ok := seconds(event, "variable_billsec", 1); ok && answered(event) {
+		h.billsec.WithLabelValues(labels...).Observe(billsec)
+	}
+}
+
+func (h *durationHandler) Describe(ch chan<- *prometheus.Desc) {
+	h.duration.Describe(ch)
+	h.billsec.Describe(ch)
+}
+
+func (h *durationHandler) Collect(ch chan<- prometheus.Metric) {
+	h.duration.Collect(ch)
+	h.billsec.Collect(ch)
+}
+
+// setupHandler keeps the distribution of the call setup times of the
+// outbound gateways. They are taken from the hangup variables, which hold the
+// milliseconds from creation to each stage, rather than from the events of
+// every stage, so that no state is kept per channel.
+type setupHandler struct {
+	postDialDelay *prometheus.HistogramVec
+	answerTime    *prometheus.HistogramVec
+}
+
+func newSetupHandler(cfg *eventConfig) eventHandler {
+	return &setupHandler{
+		postDialDelay: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "gateway_post_dial_delay_seconds",
+			Help:      "Time from the creation of the outbound channels to the first ringing or early media.",
+			Buckets:   cfg.setupBuckets,
+		}, []string{"gateway"}),
+		answerTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "gateway_answer_time_seconds",
+			Help:      "Time from the creation of the outbound channels to their answer.",
+			Buckets:   cfg.setupBuckets,
+		}, []string{"gateway"}),
+	}
+}
+
+func (h *setupHandler) subscriptions() []string {
+	return []string{"CHANNEL_HANGUP_COMPLETE"}
+}
+
+func (h *setupHandler) handle(event eslEvent) {
+	gateway := outboundGateway(event)
+	if gateway == "" {
+		return
+	}
+
+	// a stage which was not reached is 0
+	var delay float64
+	for _, header := range []string{"variable_progressmsec", "variable_progress_mediamsec"} {
+		if value, ok := seconds(event, header, 1000); ok && value > 0 && (delay == 0 || value < delay) {
+			delay = value
+		}
+	}
+	if delay > 0 {
+		h.postDialDelay.WithLabelValues(gateway).Observe(delay)
+	}
+	if answer, ok := seconds(event, "variable_answermsec", 1000); ok && answer > 0 && answered(event) {
+		h.answerTime.WithLabelValues(gateway).Observe(answer)
+	}
+}
+
+func (h *setupHandler) Describe(ch chan<- *prometheus.Desc) {
+	h.postDialDelay.Describe(ch)
+	h.answerTime.Describe(ch)
+}
+
+func (h *setupHandler) Collect(ch chan<- prometheus.Metric) {
+	h.postDialDelay.Collect(ch)
+	h.answerTime.Collect(ch)
+}
+
+// gatewayCallsHandler counts the outbound calls of each gateway, from which
+// the answer-seizure ratio and the average call duration are computed. Unlike
+// the counters of sofia status, they are not reset when a profile restarts.
+type gatewayCallsHandler struct {
+	attempted       *prometheus.CounterVec
+	answered        *prometheus.CounterVec
+	answeredSeconds *prometheus.CounterVec
+}
+
+func newGatewayCallsHandler(_ *eventConfig) eventHandler {
+	return &gatewayCallsHandler{
+		attempted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "gateway_calls_attempted_total",
+			Help:      "Number of outbound calls through the gateway which ended.",
+		}, []string{"gateway"}),
+		answered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "gateway_calls_answered_total",
+			Help:      "Number of answered outbound calls through the gateway which ended.",
+		}, []string{"gateway"}),
+		answeredSeconds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "gateway_calls_answered_seconds_total",
+			Help:      "Billable duration of the answered outbound calls through the gateway.",
+		}, []string{"gateway"}),
+	}
+}
+
+func (h *gatewayCallsHandler) subscriptions() []string {
+	return []string{"CHANNEL_HANGUP_COMPLETE"}
+}
+
+func (h *gatewayCallsHandler) handle(event eslEvent) {
+	gateway := outboundGateway(event)
+	if gateway == "" {
+		return
+	}
+
+	h.attempted.WithLabelValues(gateway).Inc()
+	if !answered(event) {
+		return
+	}
+	h.answered.WithLabelValues(gateway).Inc()
+	if billsec, ok := seconds(event, "variable_billsec", 1); ok {
+		h.answeredSeconds.WithLabelValues(gateway).Add(billsec)
+	}
+}
+
+func (h *gatewayCallsHandler) Describe(ch chan<- *prometheus.Desc) {
+	h.attempted.Describe(ch)
+	h.answered.Describe(ch)
+	h.answeredSeconds.Describe(ch)
+}
+
+func (h *gatewayCallsHandler) Collect(ch chan<- prometheus.Metric) {
+	h.attempted.Collect(ch)
+	h.answered.Collect(ch)
+	h.answeredSeconds.Collect(ch)
+}
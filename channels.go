@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Channel is a row of show channels.
+type Channel struct {
+	UUID       string `json:"uuid"`
+	Direction  string `json:"direction"`
+	Name       string `json:"name"`
+	State      string `json:"state"`
+	Context    string `json:"context"`
+	ReadCodec  string `json:"read_codec"`
+	WriteCodec string `json:"write_codec"`
+	Secure     string `json:"secure"`
+	CallState  string `json:"callstate"`
+}
+
+// channelLabels are the labels the active channels can be counted by, with
+// the value of each for a channel. They only take values out of the
+// configuration of freeswitch, never the numbers or addresses of the calls,
+// to keep the number of series bounded.
+var channelLabels = []channelLabel{
+	{"direction", func(ch *Channel) string { return ch.Direction }},
+	{"callstate", func(ch *Channel) string { return ch.CallState }},
+	{"context", func(ch *Channel) string { return ch.Context }},
+	{"read_codec", func(ch *Channel) string { return ch.ReadCodec }},
+	{"write_codec", func(ch *Channel) string { return ch.WriteCodec }},
+	{"secure", func(ch *Channel) string { return strconv.FormatBool(ch.Secure != "") }},
+	{"endpoint", func(ch *Channel) string { endpoint, _, _ := channelEndpoint(ch.Name); return endpoint }},
+	{"profile", func(ch *Channel) string { _, profile, _ := channelEndpoint(ch.Name); return profile }},
+	{"gateway", func(ch *Channel) string { _, _, gateway := channelEndpoint(ch.Name); return gateway }},
+}
+
+type channelLabel struct {
+	name  string
+	value func(*Channel) string
+}
+
+// defaultChannelLabels are the labels of the active channels unless
+// configured otherwise.
+var defaultChannelLabels = []string{"direction", "callstate", "endpoint"}
+
+func namesOfChannelLabels() []string {
+	names := make([]string, len(channelLabels))
+	for i, label := range channelLabels {
+		names[i] = label.name
+	}
+	return names
+}
+
+// channelEndpoint parses the name of a channel, e.g. sofia/internal/1000@pbx,
+// sofia/gateway/carrier/15551230000, verto.rtc/1008@pbx or loopback/1000-a.
+// The profile and gateway are only known for sofia channels, and gateway
+// channels have no profile in their name.
+func channelEndpoint(name string) (endpoint, profile, gateway string) {
+	endpoint, rest, _ := strings.Cut(name, "/")
+	endpoint, _, _ = strings.Cut(endpoint, ".")
+	if endpoint != "sofia" {
+		return endpoint, "", ""
+	}
+	profile, rest, _ = strings.Cut(rest, "/")
+	if profile == "gateway" {
+		gateway, _, _ = strings.Cut(rest, "/")
+		return endpoint, "", gateway
+	}
+	return endpoint, profile, ""
+}
+
+func channelsMetrics(ctx context.Context, c *Collector, ch chan<- prometheus.Metric) error {
+	labels := c.ChannelLabels
+	if labels == nil {
+		labels = defaultChannelLabels
+	}
+
+	values := make([]func(*Channel) string, len(labels))
+	for i, name := range labels {
+		j := slices.IndexFunc(channelLabels, func(label channelLabel) bool { return label.name == name })
+		if j < 0 {
+			return fmt.Errorf("channelsMetrics error: unknown label %q", name)
+		}
+		values[i] = channelLabels[j].value
+	}
+
+	// channels are counted by the values of their labels, joined
+	counts := make(map[string]int)
+	err := c.fsStream(ctx, "api show channels as json", func(r io.Reader) error {
+		_, err := decodeJSONRows(r, func(channel *Channel) error {
+			level.Debug(c.logger).Log("response", fmt.Sprintf("%#v", channel))
+
+			key := make([]string, len(values))
+			for i, value := range values {
+				key[i] = value(channel)
+			}
+			counts[strings.Join(key, "\x00")]++
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("channelsMetrics error: %w", err)
+	}
+
+	desc := prometheus.NewDesc(namespace+"_channels_active", "Number of channels active, by the configured labels", labels, nil)
+	for key, count := range counts {
+		var labelValues []string
+		if len(labels) > 0 {
+			labelValues = strings.Split(key, "\x00")
+		}
+		metric, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, float64(count), labelValues...)
+		if err != nil {
+			return err
+		}
+		ch <- metric
+	}
+	return nil
+}
+
+// BridgedCall is a row of show detailed_bridged_calls, the channel of the
+// a-leg with the columns of its b-leg prefixed with b_.
+type BridgedCall struct {
+	UUID        string `json:"uuid"`
+	ReadCodec   string `json:"read_codec"`
+	ReadRate    string `json:"read_rate"`
+	WriteCodec  string `json:"write_codec"`
+	WriteRate   string `json:"write_rate"`
+	BUUID       string `json:"b_uuid"`
+	BReadCodec  string `json:"b_read_codec"`
+	BReadRate   string `json:"b_read_rate"`
+	BWriteCodec string `json:"b_write_codec"`
+	BWriteRate  string `json:"b_write_rate"`
+}
+
+// transcodingMetrics counts the bridged calls whose media is transcoded,
+// the audio received on one leg being sent with another codec on the other,
+// those whose legs share a codec at different sample rates, which are
+// resampled, and with PtimeCalls those whose legs only differ by ptime,
+// which are repacketized. The listing has no ptime, it is asked for each leg
+// of at most PtimeCalls of the calls which share a codec and rate.
+func transcodingMetrics(ctx context.Context, c *Collector, ch chan<- prometheus.Metric) error {
+	type codecs struct{ a, b string }
+	type rates struct{ codec, a, b string }
+	type ptimes struct{ codec, a, b string }
+	transcoded := make(map[codecs]int)
+	resampled := make(map[rates]int)
+	repacketized := make(map[ptimes]int)
+	var sameCodec []*BridgedCall
+
+	err := c.fsStream(ctx, "api show detailed_bridged_calls as json", func(r io.Reader) error {
+		_, err := decodeJSONRows(r, func(call *BridgedCall) error {
+			level.Debug(c.logger).Log("response", fmt.Sprintf("%#v", call))
+
+			// legs without media, e.g. still ringing, have no codec
+			if call.ReadCodec == "" || call.BReadCodec == "" {
+				return nil
+			}
+			switch {
+			case call.ReadCodec != call.BWriteCodec || call.WriteCodec != call.BReadCodec:
+				transcoded[codecs{call.ReadCodec, call.BReadCodec}]++
+			case call.ReadRate != call.BWriteRate || call.WriteRate != call.BReadRate:
+				resampled[rates{call.ReadCodec, call.ReadRate, call.BReadRate}]++
+			case len(sameCodec) < c.PtimeCalls:
+				sameCodec = append(sameCodec, call)
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("transcodingMetrics error: %w", err)
+	}
+
+	for _, call := range sameCodec {
+		a, err := c.codecPtime(ctx, call.UUID)
+		var b string
+		if err == nil {
+			b, err = c.codecPtime(ctx, call.BUUID)
+		}
+		if errors.Is(err, ErrPermissionDenied) || errors.Is(err, ErrCommandNotFound) {
+			// the transcoding is still told without uuid_getvar
+			level.Debug(c.logger).Log("msg", "cannot get the ptime of bridged calls", "err", err)
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("transcodingMetrics error: %w", err)
+		}
+		if a != "" && b != "" && a != b {
+			repacketized[ptimes{call.ReadCodec, a, b}]++
+		}
+	}
+
+	desc := prometheus.NewDesc(namespace+"_bridged_calls_transcoded", "Number of bridged calls whose legs have different codecs, by codec of each leg", []string{"a_leg_codec", "b_leg_codec"}, nil)
+	for pair, count := range transcoded {
+		metric, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, float64(count), pair.a, pair.b)
+		if err != nil {
+			return err
+		}
+		ch <- metric
+	}
+
+	desc = prometheus.NewDesc(namespace+"_bridged_calls_resampled", "Number of bridged calls whose legs have the same codec at different sample rates, by sample rate of each leg", []string{"codec", "a_leg_rate", "b_leg_rate"}, nil)
+	for pair, count := range resampled {
+		metric, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, float64(count), pair.codec, pair.a, pair.b)
+		if err != nil {
+			return err
+		}
+		ch <- metric
+	}
+
+	desc = prometheus.NewDesc(namespace+"_bridged_calls_repacketized", "Number of bridged calls whose legs have the same codec and sample rate at different ptimes, by ptime of each leg", []string{"codec", "a_leg_ptime", "b_leg_ptime"}, nil)
+	for pair, count := range repacketized {
+		metric, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, float64(count), pair.codec, pair.a, pair.b)
+		if err != nil {
+			return err
+		}
+		ch <- metric
+	}
+	return nil
+}
+
+// codecPtime returns the ptime of the codec of a channel, in milliseconds,
+// or "" if it has none or hung up since it was listed.
+func (c *Collector) codecPtime(ctx context.Context, uuid string) (string, error) {
+	response, err := c.fsCommand(ctx, "api uuid_getvar "+uuid+" rtp_use_codec_ptime")
+	if errors.Is(err, ErrCommandFailed) {
+		// -ERR No such channel!
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	ptime := strings.TrimSpace(string(response))
+	if ptime == "_undef_" {
+		return "", nil
+	}
+	return ptime, nil
+}
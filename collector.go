@@ -3,16 +3,17 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
 	"math"
-	"net"
-	"net/textproto"
 	"net/url"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,6 +21,7 @@ import (
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/jpillora/backoff"
 	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/net/html/charset"
 )
@@ -27,14 +29,60 @@ import (
 // Collector implements prometheus.Collector (see below).
 // it also contains the config of the exporter.
 type Collector struct {
-	Timeout  time.Duration
+	Timeout time.Duration
+	// Username is the directory user (user@domain) to log in with userauth,
+	// empty to use the shared event socket password.
+	Username string
 	Password string
-	disables map[string]struct{}
-
-	conn  net.Conn
-	input *bufio.Reader
-	url   *url.URL
-	mutex sync.Mutex
+	// KeepAlive is the TCP keepalive period of the event socket connection.
+	KeepAlive time.Duration
+	// Persistent keeps the authenticated connection open across scrapes.
+	Persistent bool
+	// TLSConfig is used for tls:// URIs.
+	TLSConfig *tls.Config
+	// BackgroundJobs runs the collectors concurrently, sending their commands
+	// as bgapi jobs over the one connection.
+	BackgroundJobs bool
+	// RecordDir, if set, is where every command and its raw response are
+	// written to, to be served back by a replay:// URI.
+	RecordDir string
+	// CollectorTimeouts limits the time of single collectors, the others
+	// may use whatever is left of Timeout.
+	CollectorTimeouts map[string]time.Duration
+	// MaxResponseSize is the size in bytes above which a response is refused
+	// and the connection dropped, 0 means unlimited.
+	MaxResponseSize int64
+	// ChannelLabels are the labels the channels collector counts the active
+	// channels by, nil for defaultChannelLabels.
+	ChannelLabels []string
+	// PtimeCalls is the number of bridged calls sharing a codec whose legs
+	// the transcoding collector asks the ptime of at each scrape, two
+	// commands each, 0 disables it.
+	PtimeCalls int
+	disables   map[string]struct{}
+
+	// heartbeat, if set, provides the stats of the status collector while
+	// its last HEARTBEAT event is recent
+	heartbeat *heartbeatHandler
+	// statusOnly are the values of the last status command which the
+	// heartbeat does not carry, min_idle_cpu and max_sps, by metric name
+	statusOnly map[string]float64
+
+	// ctx is the context of the request which triggered the scrape, if any
+	ctx    context.Context
+	client *eslClient
+	jobs   *jobSession // set during scrapes with BackgroundJobs
+	// jobsUnavailable is set once BACKGROUND_JOB events were refused, the
+	// collectors then run sequentially
+	jobsUnavailable bool
+	pool            *eslPool
+	url             *url.URL
+	mutex           sync.Mutex
+
+	// reconnect state of the persistent connection
+	backoff   *backoff.Backoff
+	nextDial  time.Time
+	connected bool
 
 	logger log.Logger
 
@@ -50,6 +98,9 @@ type Metric struct {
 	Type       prometheus.ValueType
 	Command    string
 	RegexIndex int
+	// Header is the header of the HEARTBEAT event holding the value of a
+	// status metric, if any
+	Header string
 }
 
 const (
@@ -93,45 +144,70 @@ type Gateway struct {
 }
 
 type Registrations struct {
-	XMLName  xml.Name `xml:"result"`
-	Text     string   `xml:",chardata"`
-	RowCount string   `xml:"row_count,attr"`
-	Row      []struct {
-		Text  string `xml:",chardata"`
-		RowID string `xml:"row_id,attr"`
-
-		Type struct {
-			Text string `xml:",chardata"`
-		} `xml:"type"`
-
-		RegUser struct {
-			Text string `xml:",chardata"`
-		} `xml:"reg_user"`
-		Realm struct {
-			Text string `xml:",chardata"`
-		} `xml:"realm"`
-		Token struct {
-			Text string `xml:",chardata"`
-		} `xml:"token"`
-		Url struct {
-			Text string `xml:",chardata"`
-		} `xml:"url"`
-		Expires struct {
-			Text string `xml:",chardata"`
-		} `xml:"expires"`
-		NetworkIp struct {
-			Text string `xml:",chardata"`
-		} `xml:"network_ip"`
-		NetworkPort struct {
-			Text string `xml:",chardata"`
-		} `xml:"network_port"`
-		NetworkProto struct {
-			Text string `xml:",chardata"`
-		} `xml:"network_proto"`
-		Hostname struct {
-			Text string `xml:",chardata"`
-		} `xml:"hostname"`
-	} `xml:"row"`
+	XMLName  xml.Name       `xml:"result"`
+	Text     string         `xml:",chardata"`
+	RowCount string         `xml:"row_count,attr"`
+	Row      []Registration `xml:"row"`
+}
+
+// SofiaStatusRow is a profile, alias or gateway listed by sofia xmlstatus.
+type SofiaStatusRow struct {
+	Name  string `xml:"name"`
+	Type  string `xml:"type"`
+	Data  string `xml:"data"`
+	State string `xml:"state"`
+}
+
+// SofiaProfileInfo is the status of a profile from sofia xmlstatus profile.
+type SofiaProfileInfo struct {
+	Context        string `xml:"context"`
+	URL            string `xml:"url"`
+	BindURL        string `xml:"bind-url"`
+	TLSBindURL     string `xml:"tls-bind-url"`
+	WSBindURL      string `xml:"ws-bind-url"`
+	WSSBindURL     string `xml:"wss-bind-url"`
+	CallsIn        int    `xml:"calls-in"`
+	FailedCallsIn  int    `xml:"failed-calls-in"`
+	CallsOut       int    `xml:"calls-out"`
+	FailedCallsOut int    `xml:"failed-calls-out"`
+	Registrations  int    `xml:"registrations"`
+}
+
+type Registration struct {
+	Text  string `xml:",chardata"`
+	RowID string `xml:"row_id,attr"`
+
+	Type struct {
+		Text string `xml:",chardata"`
+	} `xml:"type"`
+
+	RegUser struct {
+		Text string `xml:",chardata"`
+	} `xml:"reg_user"`
+	Realm struct {
+		Text string `xml:",chardata"`
+	} `xml:"realm"`
+	Token struct {
+		Text string `xml:",chardata"`
+	} `xml:"token"`
+	Url struct {
+		Text string `xml:",chardata"`
+	} `xml:"url"`
+	Expires struct {
+		Text string `xml:",chardata"`
+	} `xml:"expires"`
+	NetworkIp struct {
+		Text string `xml:",chardata"`
+	} `xml:"network_ip"`
+	NetworkPort struct {
+		Text string `xml:",chardata"`
+	} `xml:"network_port"`
+	NetworkProto struct {
+		Text string `xml:",chardata"`
+	} `xml:"network_proto"`
+	Hostname struct {
+		Text string `xml:",chardata"`
+	} `xml:"hostname"`
 }
 
 type Configuration struct {
@@ -149,42 +225,46 @@ type Configuration struct {
 }
 
 type Result struct {
-	XMLName  xml.Name `xml:"result"`
-	Text     string   `xml:",chardata"`
-	RowCount string   `xml:"row_count,attr"`
-	Row      []struct {
-		Text  string `xml:",chardata"`
-		RowID string `xml:"row_id,attr"`
-		Type  struct {
-			Text string `xml:",chardata"`
-		} `xml:"type"`
-		Name struct {
-			Text string `xml:",chardata"`
-		} `xml:"name"`
-		Ikey struct {
-			Text string `xml:",chardata"`
-		} `xml:"ikey"`
-	} `xml:"row"`
+	XMLName  xml.Name    `xml:"result"`
+	Text     string      `xml:",chardata"`
+	RowCount string      `xml:"row_count,attr"`
+	Row      []ResultRow `xml:"row"`
+}
+
+type ResultRow struct {
+	Text  string `xml:",chardata"`
+	RowID string `xml:"row_id,attr"`
+	Type  struct {
+		Text string `xml:",chardata"`
+	} `xml:"type"`
+	Name struct {
+		Text string `xml:",chardata"`
+	} `xml:"name"`
+	Ikey struct {
+		Text string `xml:",chardata"`
+	} `xml:"ikey"`
 }
 
 type Verto struct {
-	XMLName xml.Name `xml:"profiles"`
-	Text    string   `xml:",chardata"`
-	Profile []struct {
+	XMLName xml.Name       `xml:"profiles"`
+	Text    string         `xml:",chardata"`
+	Profile []VertoProfile `xml:"profile"`
+}
+
+type VertoProfile struct {
+	Text string `xml:",chardata"`
+	Name struct {
+		Text string `xml:",chardata"`
+	} `xml:"name"`
+	Type struct {
+		Text string `xml:",chardata"`
+	} `xml:"type"`
+	Data struct {
 		Text string `xml:",chardata"`
-		Name struct {
-			Text string `xml:",chardata"`
-		} `xml:"name"`
-		Type struct {
-			Text string `xml:",chardata"`
-		} `xml:"type"`
-		Data struct {
-			Text string `xml:",chardata"`
-		} `xml:"data"`
-		State struct {
-			Text string `xml:",chardata"`
-		} `xml:"state"`
-	} `xml:"profile"`
+	} `xml:"data"`
+	State struct {
+		Text string `xml:",chardata"`
+	} `xml:"state"`
 }
 
 var (
@@ -197,16 +277,16 @@ var (
 		{Name: "current_channels", Type: prometheus.GaugeValue, Help: "Number of channels active", Command: "api show channels count as json"},
 		{Name: "uptime_seconds", Type: prometheus.GaugeValue, Help: "Uptime in seconds", Command: "api uptime s"},
 		{Name: "time_synced", Type: prometheus.GaugeValue, Help: "Is FreeSWITCH time in sync with exporter host time", Command: "api strepoch"},
-		{Name: "sessions_total", Type: prometheus.CounterValue, Help: "Number of sessions since startup", RegexIndex: 1},
-		{Name: "current_sessions", Type: prometheus.GaugeValue, Help: "Number of sessions active", RegexIndex: 2},
-		{Name: "current_sessions_peak", Type: prometheus.GaugeValue, Help: "Peak sessions since startup", RegexIndex: 3},
-		{Name: "current_sessions_peak_last_5min", Type: prometheus.GaugeValue, Help: "Peak sessions for the last 5 minutes", RegexIndex: 4},
-		{Name: "current_sps", Type: prometheus.GaugeValue, Help: "Number of sessions per second", RegexIndex: 5},
-		{Name: "current_sps_peak", Type: prometheus.GaugeValue, Help: "Peak sessions per second since startup", RegexIndex: 7},
-		{Name: "current_sps_peak_last_5min", Type: prometheus.GaugeValue, Help: "Peak sessions per second for the last 5 minutes", RegexIndex: 8},
+		{Name: "sessions_total", Type: prometheus.CounterValue, Help: "Number of sessions since startup", RegexIndex: 1, Header: "Session-Since-Startup"},
+		{Name: "current_sessions", Type: prometheus.GaugeValue, Help: "Number of sessions active", RegexIndex: 2, Header: "Session-Count"},
+		{Name: "current_sessions_peak", Type: prometheus.GaugeValue, Help: "Peak sessions since startup", RegexIndex: 3, Header: "Session-Peak-Max"},
+		{Name: "current_sessions_peak_last_5min", Type: prometheus.GaugeValue, Help: "Peak sessions for the last 5 minutes", RegexIndex: 4, Header: "Session-Peak-FiveMin"},
+		{Name: "current_sps", Type: prometheus.GaugeValue, Help: "Number of sessions per second", RegexIndex: 5, Header: "Session-Per-Sec-Last"},
+		{Name: "current_sps_peak", Type: prometheus.GaugeValue, Help: "Peak sessions per second since startup", RegexIndex: 7, Header: "Session-Per-Sec-Max"},
+		{Name: "current_sps_peak_last_5min", Type: prometheus.GaugeValue, Help: "Peak sessions per second for the last 5 minutes", RegexIndex: 8, Header: "Session-Per-Sec-FiveMin"},
 		{Name: "max_sps", Type: prometheus.GaugeValue, Help: "Max sessions per second allowed", RegexIndex: 6},
-		{Name: "max_sessions", Type: prometheus.GaugeValue, Help: "Max sessions allowed", RegexIndex: 9},
-		{Name: "current_idle_cpu", Type: prometheus.GaugeValue, Help: "CPU idle", RegexIndex: 11},
+		{Name: "max_sessions", Type: prometheus.GaugeValue, Help: "Max sessions allowed", RegexIndex: 9, Header: "Max-Sessions"},
+		{Name: "current_idle_cpu", Type: prometheus.GaugeValue, Help: "CPU idle", RegexIndex: 11, Header: "Idle-CPU"},
 		{Name: "min_idle_cpu", Type: prometheus.GaugeValue, Help: "Minimum CPU idle", RegexIndex: 10},
 	}
 	statusRegex = regexp.MustCompile(`(\d+) session\(s\) since startup\s+(\d+) session\(s\) - peak (\d+), last 5min (\d+)\s+(\d+) session\(s\) per Sec out of max (\d+), peak (\d+), last 5min (\d+)\s+(\d+) session\(s\) max\s+min idle cpu (\d+\.\d+)\/(\d+\.\d+)`)
@@ -221,6 +301,17 @@ func NewCollector(uri string, timeout time.Duration, password string, logger log
 		return nil, fmt.Errorf("cannot parse URI: %w", err)
 	}
 
+	// credentials in the URI take precedence, they are removed from it so
+	// that the target label does not leak them
+	var username string
+	if url.User != nil {
+		username = url.User.Username()
+		if p, ok := url.User.Password(); ok {
+			password = p
+		}
+		url.User = nil
+	}
+
 	tmp := make(map[string]struct{})
 	for i := range disables {
 		tmp[disables[i]] = struct{}{}
@@ -228,10 +319,16 @@ func NewCollector(uri string, timeout time.Duration, password string, logger log
 
 	c := &Collector{
 		Timeout:  timeout,
+		Username: username,
 		Password: password,
 		disables: tmp,
 		url:      url,
 		logger:   logger,
+		backoff: &backoff.Backoff{
+			Min:    time.Second,
+			Max:    time.Minute,
+			Jitter: true,
+		},
 		probeSuccessGauge: prometheus.NewGauge(prometheus.GaugeOpts{
 			Name: "probe_success",
 			Help: "Displays whether or not the probe was a success",
@@ -246,22 +343,35 @@ func NewCollector(uri string, timeout time.Duration, password string, logger log
 }
 
 type collector struct {
-	name   string
-	ignore bool // ignore and log command not found error
-	fn     func(*Collector, chan<- prometheus.Metric) error
+	name string
+	skip []error // error classes which are logged and skipped instead of failing the scrape
+	fn   func(context.Context, *Collector, chan<- prometheus.Metric) error
+}
+
+// skips reports whether err belongs to one of the error classes the collector skips.
+func (col *collector) skips(err error) bool {
+	for _, target := range col.skip {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
 }
 
 var collectors = []collector{
-	{"builtin", false, scapeMetrics},
-	{"status", false, scrapeStatus},
-	{"sofiastatus", false, sofiaStatusMetrics},
-	{"memory", false, memoryMetrics},
-	{"loadmodule", false, loadModuleMetrics},
-	{"endpoint", false, endpointMetrics},
-	{"codec", false, codecMetrics},
-	{"registrations", false, registrationsMetrics},
-	{"verto", true, vertoMetrics},
-	{"rtp", false, variableRtpAudioMetrics},
+	{"builtin", nil, scapeMetrics},
+	{"status", nil, scrapeStatus},
+	{"sofiastatus", nil, sofiaStatusMetrics},
+	{"sofiaprofile", nil, sofiaProfileMetrics},
+	{"memory", nil, memoryMetrics},
+	{"loadmodule", nil, loadModuleMetrics},
+	{"endpoint", nil, endpointMetrics},
+	{"codec", nil, codecMetrics},
+	{"registrations", nil, registrationsMetrics},
+	{"channels", nil, channelsMetrics},
+	{"transcoding", nil, transcodingMetrics},
+	{"verto", []error{ErrCommandNotFound}, vertoMetrics},
+	{"rtp", nil, variableRtpAudioMetrics},
 }
 
 func namesOfCollectors() []string {
@@ -272,63 +382,137 @@ func namesOfCollectors() []string {
 	return ret
 }
 
-// scrape will connect to the freeswitch instance and push metrics to the Prometheus channel.
-func (c *Collector) scrape(ch chan<- prometheus.Metric) error {
-	address := c.url.Host
-
-	if c.url.Scheme == "unix" {
-		address = c.url.Path
+// parseCollectorTimeouts converts collector=duration settings.
+func parseCollectorTimeouts(settings map[string]string) (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration, len(settings))
+	for name, value := range settings {
+		if !slices.Contains(namesOfCollectors(), name) {
+			return nil, fmt.Errorf("unknown collector %q", name)
+		}
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout of collector %s: %w", name, err)
+		}
+		timeouts[name] = timeout
 	}
+	return timeouts, nil
+}
 
-	var err error
+// scrape will connect to the freeswitch instance and push metrics to the Prometheus channel.
+func (c *Collector) scrape(ch chan<- prometheus.Metric) (err error) {
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
 
-	c.conn, err = net.DialTimeout(c.url.Scheme, address, c.Timeout)
-	if err != nil {
+	if err = c.open(ctx); err != nil {
 		return err
 	}
-	c.conn.SetDeadline(time.Now().Add(c.Timeout))
-	defer c.conn.Close()
+	defer func() {
+		c.release(err)
+	}()
 
-	c.input = bufio.NewReader(c.conn)
-
-	if err = c.fsAuth(); err != nil {
-		return err
+	if c.BackgroundJobs && !c.jobsUnavailable {
+		if err = c.collectConcurrently(ctx, ch); !errors.Is(err, errJobsUnavailable) {
+			return err
+		}
 	}
 
 	for i := range collectors {
 		if _, ok := c.disables[collectors[i].name]; ok {
 			continue
 		}
-		if err := collectors[i].fn(c, ch); err != nil {
-			if !collectors[i].ignore || !c.ignoreAndLogCommandNotFoundError(err) {
+		if c.client == nil {
+			// the previous collector left the connection unusable
+			if err = c.open(ctx); err != nil {
 				return err
 			}
 		}
+		if err = c.collect(ctx, &collectors[i], ch); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (c *Collector) ignoreAndLogCommandNotFoundError(err error) bool {
-	if strings.Contains(err.Error(), "Command not found") {
-		level.Warn(c.logger).Log("err", err)
-		return true
+// collect runs a single collector within its time budget and reports how it
+// went. Only errors which have to fail the whole scrape are returned.
+func (c *Collector) collect(ctx context.Context, col *collector, ch chan<- prometheus.Metric) error {
+	collectorCtx := ctx
+	if budget, ok := c.CollectorTimeouts[col.name]; ok {
+		var cancel context.CancelFunc
+		collectorCtx, cancel = context.WithTimeout(ctx, budget)
+		defer cancel()
 	}
-	return false
+
+	start := time.Now()
+	err := col.fn(collectorCtx, c, ch)
+	duration := time.Since(start).Seconds()
+
+	// commands missing from the esl-allowed-api list of the user never fail the scrape
+	blocked := errors.Is(err, ErrPermissionDenied)
+	for _, m := range []struct {
+		name, help string
+		value      float64
+	}{
+		{"scrape_collector_blocked", "Whether the collector was blocked by the API allowlist of the ESL user", boolToFloat64(blocked)},
+		{"scrape_collector_success", "Whether the collector succeeded", boolToFloat64(err == nil)},
+		{"scrape_collector_duration_seconds", "Duration of the collector", duration},
+	} {
+		metric, merr := prometheus.NewConstMetric(
+			prometheus.NewDesc(namespace+"_"+m.name, m.help, []string{"collector"}, nil),
+			prometheus.GaugeValue,
+			m.value,
+			col.name,
+		)
+		if merr != nil {
+			return merr
+		}
+		ch <- metric
+	}
+
+	if err == nil {
+		return nil
+	}
+	// a background job which ran out of time does not affect the connection
+	if isConnectionError(err) && c.jobs == nil {
+		c.closeClient()
+	}
+
+	switch {
+	case blocked, col.skips(err):
+		level.Warn(c.logger).Log("collector", col.name, "err", err)
+		return nil
+	case expired(collectorCtx) && !expired(ctx):
+		// the collector ran out of its own budget, the others may still finish in time
+		level.Warn(c.logger).Log("msg", "collector timed out", "collector", col.name, "duration", duration, "err", err)
+		return nil
+	}
+	return fmt.Errorf("collector %s failed: %w", col.name, err)
 }
 
-func variableRtpAudioMetrics(_ *Collector, _ chan<- prometheus.Metric) error {
+func boolToFloat64(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func variableRtpAudioMetrics(_ context.Context, _ *Collector, _ chan<- prometheus.Metric) error {
 	return nil
 }
 
-func scapeMetrics(c *Collector, ch chan<- prometheus.Metric) error {
+func scapeMetrics(ctx context.Context, c *Collector, ch chan<- prometheus.Metric) error {
 	for _, metricDef := range metricList {
 		if len(metricDef.Command) == 0 {
 			// this metric will be fetched by scapeStatus
 			continue
 		}
 
-		value, err := c.fetchMetric(&metricDef)
+		value, err := c.fetchMetric(ctx, &metricDef)
 		if err != nil {
 			return err
 		}
@@ -348,8 +532,8 @@ func scapeMetrics(c *Collector, ch chan<- prometheus.Metric) error {
 	return nil
 }
 
-func loadModuleMetrics(c *Collector, ch chan<- prometheus.Metric) error {
-	response, err := c.fsCommand("api xml_locate configuration configuration name modules.conf")
+func loadModuleMetrics(ctx context.Context, c *Collector, ch chan<- prometheus.Metric) error {
+	response, err := c.fsCommand(ctx, "api xml_locate configuration configuration name modules.conf")
 	if err != nil {
 		return err
 	}
@@ -372,7 +556,7 @@ func loadModuleMetrics(c *Collector, ch chan<- prometheus.Metric) error {
 	)
 
 	for _, m := range cfgs.Modules.Load {
-		status, err := c.fsCommand("api module_exists " + m.Module)
+		status, err := c.fsCommand(ctx, "api module_exists "+m.Module)
 		if err != nil {
 			return err
 		}
@@ -388,153 +572,305 @@ func loadModuleMetrics(c *Collector, ch chan<- prometheus.Metric) error {
 	return nil
 }
 
-func sofiaStatusMetrics(c *Collector, ch chan<- prometheus.Metric) error {
-	response, err := c.fsCommand("api sofia xmlstatus gateway")
-	if err != nil {
-		return err
-	}
+func sofiaStatusMetrics(ctx context.Context, c *Collector, ch chan<- prometheus.Metric) error {
+	return c.fsStream(ctx, "api sofia xmlstatus gateway", func(r io.Reader) error {
+		err := decodeXMLRows(r, "gateway", func(gateway *Gateway) error {
+			level.Debug(c.logger).Log("response", fmt.Sprintf("%#v", gateway))
+			level.Debug(c.logger).Log("sofia", gateway.Name, "status", gateway.Status)
+			return sofiaGatewayMetrics(gateway, ch)
+		})
+		if err != nil {
+			return fmt.Errorf("sofiaStatusMetrics error: %w", err)
+		}
+		return nil
+	})
+}
 
-	gw := Gateways{}
-	decode := xml.NewDecoder(bytes.NewReader(response))
-	decode.CharsetReader = charset.NewReaderLabel
-	err = decode.Decode(&gw)
+// sofiaProfileMetrics lists the profiles and then queries the status of each.
+// A profile is listed once per URL and under its aliases too, it is queried
+// once by its name.
+func sofiaProfileMetrics(ctx context.Context, c *Collector, ch chan<- prometheus.Metric) error {
+	var profiles []SofiaStatusRow
+	err := c.fsStream(ctx, "api sofia xmlstatus", func(r io.Reader) error {
+		err := decodeXMLRows(r, "profile", func(row *SofiaStatusRow) error {
+			if row.Type == "profile" && !slices.ContainsFunc(profiles, func(p SofiaStatusRow) bool { return p.Name == row.Name }) {
+				profiles = append(profiles, *row)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("sofiaProfileMetrics error: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("sofiaStatusMetrics error: %s, response: %s", err, string(response))
+		return err
 	}
-	level.Debug(c.logger).Log("response", fmt.Sprintf("%#v", gw))
 
-	for _, gateway := range gw.Gateway {
-		status := 0
-		if gateway.Status == "UP" {
-			status = 1
-		}
-		level.Debug(c.logger).Log("sofia", gateway.Name, "status", status)
-		fs_status, err := prometheus.NewConstMetric(
-			prometheus.NewDesc(namespace+"_sofia_gateway_status", "freeswitch gateways status", nil, prometheus.Labels{"name": gateway.Name, "proxy": gateway.Proxy, "profile": gateway.Profile, "context": gateway.Context, "scheme": gateway.Scheme, "status": gateway.Status}),
-			prometheus.GaugeValue,
-			float64(status),
-		)
+	for _, profile := range profiles {
+		err = c.fsStream(ctx, "api sofia xmlstatus profile "+profile.Name, func(r io.Reader) error {
+			err := decodeXMLRows(r, "profile-info", func(info *SofiaProfileInfo) error {
+				level.Debug(c.logger).Log("response", fmt.Sprintf("%#v", info))
+				return sofiaProfileInfoMetrics(&profile, info, ch)
+			})
+			if err != nil {
+				return fmt.Errorf("sofiaProfileMetrics error: profile %s: %w", profile.Name, err)
+			}
+			return nil
+		})
 		if err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		ch <- fs_status
-
-		call_in, err := prometheus.NewConstMetric(
-			prometheus.NewDesc(namespace+"_sofia_gateway_call_in", "freeswitch gateway call-in", nil, prometheus.Labels{"name": gateway.Name, "proxy": gateway.Proxy, "profile": gateway.Profile}),
+func sofiaProfileInfoMetrics(profile *SofiaStatusRow, info *SofiaProfileInfo, ch chan<- prometheus.Metric) error {
+	// the state is followed by the number of calls in use, e.g. RUNNING (2)
+	running := 0
+	if strings.HasPrefix(profile.State, "RUNNING") {
+		running = 1
+	}
+	labels := prometheus.Labels{"profile": profile.Name}
+
+	for _, m := range []struct {
+		name, help string
+		value      int
+	}{
+		{"running", "Whether the sofia profile is running", running},
+		{"calls_in", "Number of inbound calls of the sofia profile since it started", info.CallsIn},
+		{"failed_calls_in", "Number of failed inbound calls of the sofia profile since it started", info.FailedCallsIn},
+		{"calls_out", "Number of outbound calls of the sofia profile since it started", info.CallsOut},
+		{"failed_calls_out", "Number of failed outbound calls of the sofia profile since it started", info.FailedCallsOut},
+		{"registrations", "Number of registrations held by the sofia profile", info.Registrations},
+	} {
+		metric, err := prometheus.NewConstMetric(
+			prometheus.NewDesc(namespace+"_sofia_profile_"+m.name, m.help, nil, labels),
 			prometheus.GaugeValue,
-			float64(gateway.CallsIn),
+			float64(m.value),
 		)
 		if err != nil {
 			return err
 		}
+		ch <- metric
+	}
 
-		ch <- call_in
-
-		call_out, err := prometheus.NewConstMetric(
-			prometheus.NewDesc(namespace+"_sofia_gateway_call_out", "freeswitch gateway call-out", nil, prometheus.Labels{"name": gateway.Name, "proxy": gateway.Proxy, "profile": gateway.Profile}),
+	for _, bindURL := range []string{info.BindURL, info.TLSBindURL, info.WSBindURL, info.WSSBindURL} {
+		if bindURL == "" {
+			continue
+		}
+		metric, err := prometheus.NewConstMetric(
+			prometheus.NewDesc(namespace+"_sofia_profile_bind_url_info", "URL the sofia profile is bound to", nil, prometheus.Labels{"profile": profile.Name, "context": info.Context, "url": bindURL}),
 			prometheus.GaugeValue,
-			float64(gateway.CallsOut),
+			1,
 		)
 		if err != nil {
 			return err
 		}
+		ch <- metric
+	}
+	return nil
+}
 
-		ch <- call_out
+// gatewayStates are the registration states of the sofia gateways.
+var gatewayStates = []string{"UNREGED", "TRYING", "REGISTER", "REGED", "UNREGISTER", "FAILED", "FAIL_WAIT", "EXPIRED", "NOREG", "DOWN", "TIMEOUT"}
 
-		failed_call_in, err := prometheus.NewConstMetric(
-			prometheus.NewDesc(namespace+"_sofia_gateway_failed_call_in", "freeswitch gateway failed-call-in", nil, prometheus.Labels{"name": gateway.Name, "proxy": gateway.Proxy, "profile": gateway.Profile}),
-			prometheus.GaugeValue,
-			float64(gateway.FailedCallsIn),
-		)
-		if err != nil {
-			return err
-		}
+// gatewayPingStatuses are the statuses of the sofia gateways, as found by
+// their OPTIONS pings.
+var gatewayPingStatuses = []string{"UP", "DOWN", "INVALID"}
 
-		ch <- failed_call_in
+func sofiaGatewayMetrics(gateway *Gateway, ch chan<- prometheus.Metric) error {
+	status := 0
+	if gateway.Status == "UP" {
+		status = 1
+	}
+	fs_status, err := prometheus.NewConstMetric(
+		prometheus.NewDesc(namespace+"_sofia_gateway_status", "freeswitch gateways status", nil, prometheus.Labels{"name": gateway.Name, "proxy": gateway.Proxy, "profile": gateway.Profile, "context": gateway.Context, "scheme": gateway.Scheme}),
+		prometheus.GaugeValue,
+		float64(status),
+	)
+	if err != nil {
+		return err
+	}
 
-		failed_call_out, err := prometheus.NewConstMetric(
-			prometheus.NewDesc(namespace+"_sofia_gateway_failed_call_out", "freeswitch gateway failed-call-out", nil, prometheus.Labels{"name": gateway.Name, "proxy": gateway.Proxy, "profile": gateway.Profile}),
-			prometheus.GaugeValue,
-			float64(gateway.FailedCallsOut),
-		)
-		if err != nil {
-			return err
-		}
+	ch <- fs_status
 
-		ch <- failed_call_out
+	call_in, err := prometheus.NewConstMetric(
+		prometheus.NewDesc(namespace+"_sofia_gateway_call_in", "freeswitch gateway call-in", nil, prometheus.Labels{"name": gateway.Name, "proxy": gateway.Proxy, "profile": gateway.Profile}),
+		prometheus.GaugeValue,
+		float64(gateway.CallsIn),
+	)
+	if err != nil {
+		return err
+	}
 
-		ping, err := prometheus.NewConstMetric(
-			prometheus.NewDesc(namespace+"_sofia_gateway_ping", "freeswitch gateway ping", nil, prometheus.Labels{"name": gateway.Name, "proxy": gateway.Proxy, "profile": gateway.Profile}),
-			prometheus.GaugeValue,
-			float64(gateway.Ping),
-		)
-		if err != nil {
-			return err
-		}
+	ch <- call_in
 
-		ch <- ping
+	call_out, err := prometheus.NewConstMetric(
+		prometheus.NewDesc(namespace+"_sofia_gateway_call_out", "freeswitch gateway call-out", nil, prometheus.Labels{"name": gateway.Name, "proxy": gateway.Proxy, "profile": gateway.Profile}),
+		prometheus.GaugeValue,
+		float64(gateway.CallsOut),
+	)
+	if err != nil {
+		return err
+	}
 
-		pingfreq, err := prometheus.NewConstMetric(
-			prometheus.NewDesc(namespace+"_sofia_gateway_pingfreq", "freeswitch gateway pingfreq", nil, prometheus.Labels{"name": gateway.Name, "proxy": gateway.Proxy, "profile": gateway.Profile}),
-			prometheus.GaugeValue,
-			float64(gateway.PingFreq),
-		)
-		if err != nil {
-			return err
-		}
+	ch <- call_out
 
-		ch <- pingfreq
+	failed_call_in, err := prometheus.NewConstMetric(
+		prometheus.NewDesc(namespace+"_sofia_gateway_failed_call_in", "freeswitch gateway failed-call-in", nil, prometheus.Labels{"name": gateway.Name, "proxy": gateway.Proxy, "profile": gateway.Profile}),
+		prometheus.GaugeValue,
+		float64(gateway.FailedCallsIn),
+	)
+	if err != nil {
+		return err
+	}
 
-		pingmin, err := prometheus.NewConstMetric(
-			prometheus.NewDesc(namespace+"_sofia_gateway_pingmin", "freeswitch gateway pingmin", nil, prometheus.Labels{"name": gateway.Name, "proxy": gateway.Proxy, "profile": gateway.Profile}),
-			prometheus.GaugeValue,
-			float64(gateway.PingMin),
-		)
-		if err != nil {
-			return err
-		}
+	ch <- failed_call_in
 
-		ch <- pingmin
+	failed_call_out, err := prometheus.NewConstMetric(
+		prometheus.NewDesc(namespace+"_sofia_gateway_failed_call_out", "freeswitch gateway failed-call-out", nil, prometheus.Labels{"name": gateway.Name, "proxy": gateway.Proxy, "profile": gateway.Profile}),
+		prometheus.GaugeValue,
+		float64(gateway.FailedCallsOut),
+	)
+	if err != nil {
+		return err
+	}
 
-		pingmax, err := prometheus.NewConstMetric(
-			prometheus.NewDesc(namespace+"_sofia_gateway_pingmax", "freeswitch gateway pingmax", nil, prometheus.Labels{"name": gateway.Name, "proxy": gateway.Proxy, "profile": gateway.Profile}),
-			prometheus.GaugeValue,
-			float64(gateway.PingMax),
-		)
-		if err != nil {
-			return err
-		}
+	ch <- failed_call_out
+
+	ping, err := prometheus.NewConstMetric(
+		prometheus.NewDesc(namespace+"_sofia_gateway_ping", "freeswitch gateway ping", nil, prometheus.Labels{"name": gateway.Name, "proxy": gateway.Proxy, "profile": gateway.Profile}),
+		prometheus.GaugeValue,
+		float64(gateway.Ping),
+	)
+	if err != nil {
+		return err
+	}
+
+	ch <- ping
+
+	// deprecated, the same value as ping_interval_seconds
+	pingfreq, err := prometheus.NewConstMetric(
+		prometheus.NewDesc(namespace+"_sofia_gateway_pingfreq", "freeswitch gateway pingfreq", nil, prometheus.Labels{"name": gateway.Name, "proxy": gateway.Proxy, "profile": gateway.Profile}),
+		prometheus.GaugeValue,
+		float64(gateway.PingFreq),
+	)
+	if err != nil {
+		return err
+	}
+
+	ch <- pingfreq
+
+	pingmin, err := prometheus.NewConstMetric(
+		prometheus.NewDesc(namespace+"_sofia_gateway_pingmin", "freeswitch gateway pingmin", nil, prometheus.Labels{"name": gateway.Name, "proxy": gateway.Proxy, "profile": gateway.Profile}),
+		prometheus.GaugeValue,
+		float64(gateway.PingMin),
+	)
+	if err != nil {
+		return err
+	}
+
+	ch <- pingmin
+
+	pingmax, err := prometheus.NewConstMetric(
+		prometheus.NewDesc(namespace+"_sofia_gateway_pingmax", "freeswitch gateway pingmax", nil, prometheus.Labels{"name": gateway.Name, "proxy": gateway.Proxy, "profile": gateway.Profile}),
+		prometheus.GaugeValue,
+		float64(gateway.PingMax),
+	)
+	if err != nil {
+		return err
+	}
 
-		ch <- pingmax
+	ch <- pingmax
 
-		pingcount, err := prometheus.NewConstMetric(
-			prometheus.NewDesc(namespace+"_sofia_gateway_pingcount", "freeswitch gateway pingcount", nil, prometheus.Labels{"name": gateway.Name, "proxy": gateway.Proxy, "profile": gateway.Profile}),
+	pingcount, err := prometheus.NewConstMetric(
+		prometheus.NewDesc(namespace+"_sofia_gateway_pingcount", "freeswitch gateway pingcount", nil, prometheus.Labels{"name": gateway.Name, "proxy": gateway.Proxy, "profile": gateway.Profile}),
+		prometheus.GaugeValue,
+		float64(gateway.PingCount),
+	)
+	if err != nil {
+		return err
+	}
+
+	ch <- pingcount
+
+	pingtime, err := prometheus.NewConstMetric(
+		prometheus.NewDesc(namespace+"_sofia_gateway_pingtime", "freeswitch gateway pingtime", nil, prometheus.Labels{"name": gateway.Name, "proxy": gateway.Proxy, "profile": gateway.Profile}),
+		prometheus.GaugeValue,
+		float64(gateway.PingTime),
+	)
+	if err != nil {
+		return err
+	}
+
+	ch <- pingtime
+
+	labels := prometheus.Labels{"name": gateway.Name, "proxy": gateway.Proxy, "profile": gateway.Profile}
+	if err := stateSetMetrics(namespace+"_sofia_gateway_state", "Registration state of the gateway, 1 for the current one", "state", gatewayStates, gateway.State, labels, ch); err != nil {
+		return err
+	}
+	if err := stateSetMetrics(namespace+"_sofia_gateway_ping_status", "Ping status of the gateway, 1 for the current one", "status", gatewayPingStatuses, gateway.Status, labels, ch); err != nil {
+		return err
+	}
+
+	// uptime-usec is 0 while the gateway is down
+	uptime, _ := strconv.ParseFloat(gateway.UptimeUsec, 64)
+	for _, m := range []struct {
+		name, help string
+		value      float64
+	}{
+		{"uptime_seconds", "Time since the gateway went up", uptime / 1e6},
+		{"register_expires_seconds", "Expiry of the registrations of the gateway", float64(gateway.Expires)},
+		{"register_interval_seconds", "Interval between the registrations of the gateway", float64(gateway.FReq)},
+		{"ping_interval_seconds", "Interval between the OPTIONS pings of the gateway", float64(gateway.PingFreq)},
+		{"pinging", "Whether a ping of the gateway is waiting for its reply", float64(gateway.Pinging)},
+	} {
+		metric, err := prometheus.NewConstMetric(
+			prometheus.NewDesc(namespace+"_sofia_gateway_"+m.name, m.help, nil, labels),
 			prometheus.GaugeValue,
-			float64(gateway.PingCount),
+			m.value,
 		)
 		if err != nil {
 			return err
 		}
+		ch <- metric
+	}
+	return nil
+}
 
-		ch <- pingcount
-
-		pingtime, err := prometheus.NewConstMetric(
-			prometheus.NewDesc(namespace+"_sofia_gateway_pingtime", "freeswitch gateway pingtime", nil, prometheus.Labels{"name": gateway.Name, "proxy": gateway.Proxy, "profile": gateway.Profile}),
+// stateSetMetrics sends one series of name by state, with state as the value
+// of label: 1 for current and 0 for the others, so that a transition changes
+// values rather than series. A current state which is not known gets a
+// series of its own.
+func stateSetMetrics(name, help, label string, states []string, current string, labels prometheus.Labels, ch chan<- prometheus.Metric) error {
+	if current != "" && !slices.Contains(states, current) {
+		states = append(slices.Clip(states), current)
+	}
+	for _, state := range states {
+		value := 0
+		if state == current {
+			value = 1
+		}
+		stateLabels := prometheus.Labels{label: state}
+		for k, v := range labels {
+			stateLabels[k] = v
+		}
+		metric, err := prometheus.NewConstMetric(
+			prometheus.NewDesc(name, help, nil, stateLabels),
 			prometheus.GaugeValue,
-			float64(gateway.PingTime),
+			float64(value),
 		)
 		if err != nil {
 			return err
 		}
-
-		ch <- pingtime
+		ch <- metric
 	}
 	return nil
 }
 
-func memoryMetrics(c *Collector, ch chan<- prometheus.Metric) error {
-	response, err := c.fsCommand("api memory")
+func memoryMetrics(ctx context.Context, c *Collector, ch chan<- prometheus.Metric) error {
+	response, err := c.fsCommand(ctx, "api memory")
 	if err != nil {
 		return err
 	}
@@ -575,129 +911,120 @@ func memoryMetrics(c *Collector, ch chan<- prometheus.Metric) error {
 	return nil
 }
 
-func endpointMetrics(c *Collector, ch chan<- prometheus.Metric) error {
-	response, err := c.fsCommand("api show endpoint as xml")
-	if err != nil {
-		return err
-	}
-
-	rt := Result{}
-	decode := xml.NewDecoder(bytes.NewReader(response))
-	decode.CharsetReader = charset.NewReaderLabel
-	err = decode.Decode(&rt)
-	if err != nil {
-		return fmt.Errorf("endpointMetrics error: %s, response: %s", err, string(response))
-	}
-	level.Debug(c.logger).Log("response", fmt.Sprintf("%#v", rt))
+func endpointMetrics(ctx context.Context, c *Collector, ch chan<- prometheus.Metric) error {
+	return c.fsStream(ctx, "api show endpoint as xml", func(r io.Reader) error {
+		err := decodeXMLRows(r, "row", func(ep *ResultRow) error {
+			level.Debug(c.logger).Log("response", fmt.Sprintf("%#v", ep))
+
+			ep_load, err := prometheus.NewConstMetric(
+				prometheus.NewDesc(namespace+"_endpoint_status", "freeswitch endpoint status", nil, prometheus.Labels{"type": ep.Type.Text, "name": ep.Name.Text, "ikey": ep.Ikey.Text}),
+				prometheus.GaugeValue,
+				float64(1),
+			)
+			if err != nil {
+				return err
+			}
 
-	for _, ep := range rt.Row {
-		ep_load, err := prometheus.NewConstMetric(
-			prometheus.NewDesc(namespace+"_endpoint_status", "freeswitch endpoint status", nil, prometheus.Labels{"type": ep.Type.Text, "name": ep.Name.Text, "ikey": ep.Ikey.Text}),
-			prometheus.GaugeValue,
-			float64(1),
-		)
+			ch <- ep_load
+			return nil
+		})
 		if err != nil {
-			return err
+			return fmt.Errorf("endpointMetrics error: %w", err)
 		}
-
-		ch <- ep_load
-	}
-	return nil
+		return nil
+	})
 }
 
-func registrationsMetrics(c *Collector, ch chan<- prometheus.Metric) error {
-	response, err := c.fsCommand("api show registrations as xml")
-	if err != nil {
-		return err
-	}
-	rt := Registrations{}
-	decode := xml.NewDecoder(bytes.NewReader(response))
-	decode.CharsetReader = charset.NewReaderLabel
-	err = decode.Decode(&rt)
-	if err != nil {
-		return fmt.Errorf("registrationsMetrics error: %s, response: %s", err, string(response))
-	}
-	level.Debug(c.logger).Log("response", fmt.Sprintf("%#v", rt))
+func registrationsMetrics(ctx context.Context, c *Collector, ch chan<- prometheus.Metric) error {
+	return c.fsStream(ctx, "api show registrations as xml", func(r io.Reader) error {
+		err := decodeXMLRows(r, "row", func(cc *Registration) error {
+			level.Debug(c.logger).Log("response", fmt.Sprintf("%#v", cc))
+
+			cc_load, err := prometheus.NewConstMetric(
+				prometheus.NewDesc(namespace+"_registration_details", "freeswitch registration status", nil, prometheus.Labels{"reg_user": cc.RegUser.Text, "hostname": cc.Hostname.Text, "realm": cc.Realm.Text, "token": cc.Token.Text, "url": cc.Url.Text, "expires": cc.Expires.Text, "network_ip": cc.NetworkIp.Text, "network_port": cc.NetworkPort.Text, "network_proto": cc.NetworkProto.Text}),
+				prometheus.GaugeValue,
+				float64(1),
+			)
+			if err != nil {
+				return err
+			}
 
-	for _, cc := range rt.Row {
-		cc_load, err := prometheus.NewConstMetric(
-			prometheus.NewDesc(namespace+"_registration_details", "freeswitch registration status", nil, prometheus.Labels{"reg_user": cc.RegUser.Text, "hostname": cc.Hostname.Text, "realm": cc.Realm.Text, "token": cc.Token.Text, "url": cc.Url.Text, "expires": cc.Expires.Text, "network_ip": cc.NetworkIp.Text, "network_port": cc.NetworkPort.Text, "network_proto": cc.NetworkProto.Text}),
-			prometheus.GaugeValue,
-			float64(1),
-		)
+			ch <- cc_load
+			return nil
+		})
 		if err != nil {
-			return err
+			return fmt.Errorf("registrationsMetrics error: %w", err)
 		}
-
-		ch <- cc_load
-	}
-	return nil
+		return nil
+	})
 }
 
-func codecMetrics(c *Collector, ch chan<- prometheus.Metric) error {
-	response, err := c.fsCommand("api show codec as xml")
-	if err != nil {
-		return err
-	}
-	rt := Result{}
-	decode := xml.NewDecoder(bytes.NewReader(response))
-	decode.CharsetReader = charset.NewReaderLabel
-	err = decode.Decode(&rt)
-	if err != nil {
-		return fmt.Errorf("codecMetrics error: %s, response: %s", err, string(response))
-	}
-	level.Debug(c.logger).Log("response", fmt.Sprintf("%#v", rt))
-	for _, cc := range rt.Row {
-		cc_load, err := prometheus.NewConstMetric(
-			prometheus.NewDesc(namespace+"_codec_status", "freeswitch endpoint status", nil, prometheus.Labels{"type": cc.Type.Text, "name": cc.Name.Text, "ikey": cc.Ikey.Text}),
-			prometheus.GaugeValue,
-			float64(1),
-		)
+func codecMetrics(ctx context.Context, c *Collector, ch chan<- prometheus.Metric) error {
+	return c.fsStream(ctx, "api show codec as xml", func(r io.Reader) error {
+		err := decodeXMLRows(r, "row", func(cc *ResultRow) error {
+			level.Debug(c.logger).Log("response", fmt.Sprintf("%#v", cc))
+
+			cc_load, err := prometheus.NewConstMetric(
+				prometheus.NewDesc(namespace+"_codec_status", "freeswitch endpoint status", nil, prometheus.Labels{"type": cc.Type.Text, "name": cc.Name.Text, "ikey": cc.Ikey.Text}),
+				prometheus.GaugeValue,
+				float64(1),
+			)
+			if err != nil {
+				return err
+			}
+
+			ch <- cc_load
+			return nil
+		})
 		if err != nil {
-			return err
+			return fmt.Errorf("codecMetrics error: %w", err)
 		}
-
-		ch <- cc_load
-	}
-	return nil
+		return nil
+	})
 }
 
-func vertoMetrics(c *Collector, ch chan<- prometheus.Metric) error {
-	response, err := c.fsCommand("api verto xmlstatus")
-	if err != nil {
-		return err
-	}
+func vertoMetrics(ctx context.Context, c *Collector, ch chan<- prometheus.Metric) error {
+	return c.fsStream(ctx, "api verto xmlstatus", func(r io.Reader) error {
+		err := decodeXMLRows(r, "profile", func(cc *VertoProfile) error {
+			level.Debug(c.logger).Log("response", fmt.Sprintf("%#v", cc))
 
-	vt := Verto{}
-	decode := xml.NewDecoder(bytes.NewReader(response))
-	decode.CharsetReader = charset.NewReaderLabel
-	err = decode.Decode(&vt)
-	if err != nil {
-		return fmt.Errorf("vertoMetrics error: %s, response: %s", err, string(response))
-	}
-	level.Debug(c.logger).Log("response", fmt.Sprintf("%#v", vt))
+			vt_status := 0
+			if cc.State.Text == "RUNNING" {
+				vt_status = 1
+			}
+			vt_load, err := prometheus.NewConstMetric(
+				prometheus.NewDesc(namespace+"_verto_status", "freeswitch endpoint status", nil, prometheus.Labels{"name": cc.Name.Text, "type": cc.Type.Text, "data": cc.Data.Text}),
+				prometheus.GaugeValue,
+				float64(vt_status),
+			)
+			if err != nil {
+				return err
+			}
 
-	for _, cc := range vt.Profile {
-		vt_status := 0
-		if cc.State.Text == "RUNNING" {
-			vt_status = 1
-		}
-		vt_load, err := prometheus.NewConstMetric(
-			prometheus.NewDesc(namespace+"_verto_status", "freeswitch endpoint status", nil, prometheus.Labels{"name": cc.Name.Text, "type": cc.Type.Text, "data": cc.Data.Text}),
-			prometheus.GaugeValue,
-			float64(vt_status),
-		)
+			ch <- vt_load
+			return nil
+		})
 		if err != nil {
-			return err
+			return fmt.Errorf("vertoMetrics error: %w", err)
 		}
+		return nil
+	})
+}
 
-		ch <- vt_load
+func scrapeStatus(ctx context.Context, c *Collector, ch chan<- prometheus.Metric) error {
+	// min_idle_cpu and max_sps are not part of the heartbeat, the status
+	// command has to run once for them to be known
+	if c.heartbeat != nil && c.statusOnly != nil {
+		if event := c.heartbeat.latest(); event != nil {
+			ok, err := heartbeatMetrics(event, c.statusOnly, ch)
+			if ok || err != nil {
+				return err
+			}
+			level.Debug(c.logger).Log("msg", "incomplete heartbeat, falling back to the status command")
+		}
 	}
-	return nil
-}
 
-func scrapeStatus(c *Collector, ch chan<- prometheus.Metric) error {
-	response, err := c.fsCommand("api status")
+	response, err := c.fsCommand(ctx, "api status")
 	if err != nil {
 		return err
 	}
@@ -707,6 +1034,7 @@ func scrapeStatus(c *Collector, ch chan<- prometheus.Metric) error {
 		return errors.New("error parsing status")
 	}
 
+	statusOnly := make(map[string]float64)
 	for _, metricDef := range metricList {
 		if len(metricDef.Command) != 0 {
 			// this metric will be fetched by fetchMetric
@@ -722,6 +1050,9 @@ func scrapeStatus(c *Collector, ch chan<- prometheus.Metric) error {
 		if err != nil {
 			return fmt.Errorf("error parsing status: %w", err)
 		}
+		if len(metricDef.Header) == 0 {
+			statusOnly[metricDef.Name] = value
+		}
 
 		metric, err := prometheus.NewConstMetric(
 			prometheus.NewDesc(namespace+"_"+metricDef.Name, metricDef.Help, nil, nil),
@@ -734,28 +1065,33 @@ func scrapeStatus(c *Collector, ch chan<- prometheus.Metric) error {
 
 		ch <- metric
 	}
+	c.statusOnly = statusOnly
 
 	return nil
 }
 
-func (c *Collector) fetchMetric(metricDef *Metric) (float64, error) {
+func (c *Collector) fetchMetric(ctx context.Context, metricDef *Metric) (float64, error) {
+	switch metricDef.Name {
+	case "current_calls", "current_channels", "detailed_bridged_calls", "detailed_calls", "registrations", "bridged_calls":
+		// only the count is used, the rows of the detailed listings are not even read
+		var count float64
+		err := c.fsStream(ctx, metricDef.Command, func(r io.Reader) (err error) {
+			count, err = decodeJSONRows[json.RawMessage](r, nil)
+			if err != nil {
+				return fmt.Errorf("cannot read JSON response for %s: %w", metricDef.Name, err)
+			}
+			return nil
+		})
+		return count, err
+	}
+
 	now := time.Now()
-	response, err := c.fsCommand(metricDef.Command)
+	response, err := c.fsCommand(ctx, metricDef.Command)
 	if err != nil {
 		return 0, err
 	}
 
 	switch metricDef.Name {
-	case "current_calls", "current_channels", "detailed_bridged_calls", "detailed_calls", "registrations", "bridged_calls":
-		r := struct {
-			Count float64 `json:"row_count"`
-		}{}
-
-		err = json.Unmarshal(response, &r)
-		if err != nil {
-			return 0, fmt.Errorf("cannot read JSON response for %s: %w", metricDef.Name, err)
-		}
-		return r.Count, nil
 	case "uptime_seconds":
 		raw := string(response)
 		if raw[len(raw)-1:] == "\n" {
@@ -787,67 +1123,29 @@ func (c *Collector) fetchMetric(metricDef *Metric) (float64, error) {
 	return 0, fmt.Errorf("unknown metric: %s", metricDef.Name)
 }
 
-func (c *Collector) fsCommand(command string) ([]byte, error) {
-	_, err := io.WriteString(c.conn, command+"\n\n")
-	if err != nil {
-		return nil, fmt.Errorf("cannot write command: %w", err)
-	}
-
-	mimeReader := textproto.NewReader(c.input)
-	message, err := mimeReader.ReadMIMEHeader()
-	if err != nil {
-		return nil, fmt.Errorf("cannot read command response: %w", err)
-	}
-
-	value := message.Get("Content-Length")
-	if value == "" {
-		return nil, errors.New("missing header 'Content-Length'")
-	}
-	length, err := strconv.Atoi(value)
-	if err != nil {
-		return nil, err
+func (c *Collector) fsCommand(ctx context.Context, command string) ([]byte, error) {
+	if c.jobs != nil {
+		return c.jobs.run(ctx, command)
 	}
-
-	body := make([]byte, length)
-	_, err = io.ReadFull(c.input, body)
-	if err != nil {
-		return nil, err
-	}
-
-	return body, nil
+	return c.client.command(ctx, command)
 }
 
-func (c *Collector) fsAuth() error {
-	mimeReader := textproto.NewReader(c.input)
-	message, err := mimeReader.ReadMIMEHeader()
-
-	if err != nil {
-		return fmt.Errorf("read auth failed: %w", err)
-	}
-
-	if message.Get("Content-Type") != "auth/request" {
-		return errors.New("auth failed: unknown content-type")
-	}
-
-	_, err = io.WriteString(c.conn, fmt.Sprintf("auth %s\n\n", c.Password))
-	if err != nil {
-		return fmt.Errorf("write auth failed: %w", err)
-	}
-
-	message, err = mimeReader.ReadMIMEHeader()
-	if err != nil {
-		return fmt.Errorf("read auth failed: %w", err)
-	}
-
-	if message.Get("Content-Type") != "command/reply" {
-		return errors.New("auth failed: unknown reply")
-	}
-
-	if message.Get("Reply-Text") != "+OK accepted" {
-		return fmt.Errorf("auth failed: %s", message.Get("Reply-Text"))
+// fsStream sends command and calls decode with its response, which is read
+// from the connection while decoding. Results of background jobs arrive
+// within an event and are decoded from memory.
+func (c *Collector) fsStream(ctx context.Context, command string, decode func(io.Reader) error) error {
+	if c.jobs != nil {
+		response, err := c.jobs.run(ctx, command)
+		if err != nil {
+			return err
+		}
+		return decode(bytes.NewReader(response))
 	}
+	return c.client.stream(ctx, command, decode)
+}
 
-	return nil
+func (c *Collector) fsAuth(ctx context.Context) error {
+	return c.client.auth(ctx, c.Username, c.Password)
 }
 
 // Describe implements prometheus.Collector.
@@ -869,6 +1167,9 @@ func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 		c.probeSuccessGauge.Set(0)
 		level.Error(c.logger).Log("duration", duration, "err", err)
 		totalScrapes.WithLabelValues(c.url.String(), "failed").Inc()
+		if errors.Is(err, ErrResponseTooLarge) {
+			responsesTooLarge.WithLabelValues(c.url.String()).Inc()
+		}
 	} else {
 		c.probeSuccessGauge.Set(1)
 		totalScrapes.WithLabelValues(c.url.String(), "success").Inc()
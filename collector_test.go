@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/jpillora/backoff"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// volatileMetrics change with every scrape and are left out of golden files.
+var volatileMetrics = []string{
+	"probe_duration_seconds",
+	namespace + "_scrape_collector_duration_seconds",
+	namespace + "_heartbeat_age_seconds",
+}
+
+// newTestCollector returns a collector for server running only the collectors named.
+func newTestCollector(t *testing.T, server *fakeServer, names ...string) *Collector {
+	t.Helper()
+
+	var disables []string
+	for _, name := range namesOfCollectors() {
+		if !slices.Contains(names, name) {
+			disables = append(disables, name)
+		}
+	}
+
+	c, err := NewCollector(server.uri(), 5*time.Second, fakePassword, log.NewNopLogger(), disables...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// gather scrapes c and renders the metrics in the text format.
+func gather(t *testing.T, c prometheus.Collector) []byte {
+	t.Helper()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	for _, family := range families {
+		if slices.Contains(volatileMetrics, family.GetName()) {
+			continue
+		}
+		if _, err = expfmt.MetricFamilyToText(&buf, family); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// scrape runs a single scrape of c and returns its error.
+func scrape(c *Collector) error {
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		for range ch {
+		}
+		close(done)
+	}()
+
+	err := c.scrape(ch)
+	close(ch)
+	<-done
+	return err
+}
+
+func compareGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("metrics differ from %s (run with -update to accept)\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+func syncedClock(server *fakeServer) {
+	server.handle("api strepoch", fakeResponse{body: strconv.FormatInt(time.Now().Unix(), 10)})
+}
+
+func TestCollectorsGolden(t *testing.T) {
+	for _, col := range collectors {
+		t.Run(col.name, func(t *testing.T) {
+			server := newFakeServer(t)
+			syncedClock(server)
+
+			c := newTestCollector(t, server, col.name)
+			compareGolden(t, col.name, gather(t, c))
+		})
+	}
+}
+
+func TestBackgroundJobs(t *testing.T) {
+	server := newFakeServer(t)
+	syncedClock(server)
+
+	sequential := gather(t, newTestCollector(t, server, namesOfCollectors()...))
+
+	c := newTestCollector(t, server, namesOfCollectors()...)
+	c.BackgroundJobs = true
+	concurrent := gather(t, c)
+
+	if !bytes.Equal(sequential, concurrent) {
+		t.Errorf("bgapi mode differs from sequential mode\nbgapi:\n%s\nsequential:\n%s", concurrent, sequential)
+	}
+	if !slices.Contains(server.received(), "noevents") {
+		t.Error("background job session not stopped")
+	}
+}
+
+func TestBackgroundJobsRefused(t *testing.T) {
+	server := newFakeServer(t)
+	syncedClock(server)
+	// a userauth user without BACKGROUND_JOB in esl-allowed-events
+	server.handle("event json BACKGROUND_JOB", fakeResponse{reply: "-ERR permission denied"})
+
+	sequential := gather(t, newTestCollector(t, server, namesOfCollectors()...))
+
+	c := newTestCollector(t, server, namesOfCollectors()...)
+	c.BackgroundJobs = true
+	for i := 0; i < 2; i++ {
+		if fallback := gather(t, c); !bytes.Equal(sequential, fallback) {
+			t.Errorf("fallback differs from sequential mode\nfallback:\n%s\nsequential:\n%s", fallback, sequential)
+		}
+	}
+	subscriptions := slices.DeleteFunc(server.received(), func(command string) bool { return command != "event json BACKGROUND_JOB" })
+	if len(subscriptions) != 1 {
+		t.Errorf("expected bgapi to be tried once, got %d times", len(subscriptions))
+	}
+}
+
+func TestCollectorErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		collector string
+		command   string
+		response  fakeResponse
+		timeout   time.Duration
+		timeouts  map[string]time.Duration
+		limit     int64
+		err       error
+	}{
+		{
+			name:      "command not found is skipped",
+			collector: "verto",
+			command:   "api verto xmlstatus",
+			response:  fakeResponse{body: "-ERR verto Command not found!\n"},
+		},
+		{
+			name:      "command not found fails",
+			collector: "memory",
+			command:   "api memory",
+			response:  fakeResponse{body: "-ERR memory Command not found!\n"},
+			err:       ErrCommandNotFound,
+		},
+		{
+			name:      "permission denied is blocked",
+			collector: "memory",
+			command:   "api memory",
+			response:  fakeResponse{reply: "-ERR permission denied"},
+		},
+		{
+			name:      "other errors fail",
+			collector: "status",
+			command:   "api status",
+			response:  fakeResponse{body: "-ERR no reply\n"},
+			err:       ErrCommandFailed,
+		},
+		{
+			name:      "disconnect",
+			collector: "status",
+			command:   "api status",
+			response:  fakeResponse{disconnect: true},
+			err:       ErrDisconnected,
+		},
+		{
+			name:      "malformed frame",
+			collector: "codec",
+			command:   "api show codec as xml",
+			response:  fakeResponse{raw: "Content-Length: 12\n\n<result/>\n\n"},
+			err:       ErrMalformedFrame,
+		},
+		{
+			name:      "response cut short",
+			collector: "registrations",
+			command:   "api show registrations as xml",
+			response:  fakeResponse{raw: "Content-Length: 500\nContent-Type: api/response\n\n<result row_count=\"1\">\n  <row row_id=\"1\">", disconnect: true},
+			err:       ErrDisconnected,
+		},
+		{
+			name:      "response too large",
+			collector: "registrations",
+			limit:     512,
+			err:       ErrResponseTooLarge,
+		},
+		{
+			name:      "response within limit",
+			collector: "status",
+			limit:     512,
+		},
+		{
+			name:      "slow reply over scrape timeout",
+			collector: "registrations",
+			command:   "api show registrations as xml",
+			response:  fakeResponse{delay: time.Second},
+			timeout:   100 * time.Millisecond,
+			err:       context.DeadlineExceeded,
+		},
+		{
+			name:      "slow reply over collector budget",
+			collector: "registrations",
+			command:   "api show registrations as xml",
+			response:  fakeResponse{delay: time.Second},
+			timeouts:  map[string]time.Duration{"registrations": 100 * time.Millisecond},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newFakeServer(t)
+			if tc.command != "" {
+				server.handle(tc.command, tc.response)
+			}
+
+			c := newTestCollector(t, server, tc.collector)
+			c.CollectorTimeouts = tc.timeouts
+			c.MaxResponseSize = tc.limit
+			if tc.timeout > 0 {
+				c.Timeout = tc.timeout
+			}
+			err := scrape(c)
+			switch {
+			case tc.err == nil && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tc.err != nil && !errors.Is(err, tc.err):
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestAuth(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		uri      string
+		password string
+		login    string
+		err      error
+	}{
+		{name: "password", password: fakePassword, login: "auth " + fakePassword},
+		{name: "userauth", uri: "monitor%40example.com:" + fakePassword + "@", login: "userauth monitor@example.com:" + fakePassword},
+		{name: "wrong password", password: "secret", err: ErrAuthRejected},
+		{name: "wrong user password", uri: "monitor%40example.com:secret@", err: ErrAuthRejected},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newFakeServer(t)
+			uri := "tcp://" + tc.uri + server.listener.Addr().String()
+
+			c, err := NewCollector(uri, 5*time.Second, tc.password, log.NewNopLogger(), namesOfCollectors()...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = scrape(c)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+			if tc.login != "" && !slices.Contains(server.received(), tc.login) {
+				t.Errorf("expected login with %q, got %q", tc.login, server.received())
+			}
+		})
+	}
+}
+
+func TestChannelLabels(t *testing.T) {
+	server := newFakeServer(t)
+	c := newTestCollector(t, server, "channels")
+	c.ChannelLabels = namesOfChannelLabels()
+	compareGolden(t, "channels_labels", gather(t, c))
+}
+
+func TestChannelEndpoint(t *testing.T) {
+	tests := []struct {
+		name                       string
+		endpoint, profile, gateway string
+	}{
+		{"sofia/internal/1000@pbx.example", "sofia", "internal", ""},
+		{"sofia/gateway/carrier-a/+15551239000", "sofia", "", "carrier-a"},
+		{"verto.rtc/1008@pbx.example", "verto", "", ""},
+		{"loopback/1002-a", "loopback", "", ""},
+		{"", "", "", ""},
+	}
+	for _, tt := range tests {
+		endpoint, profile, gateway := channelEndpoint(tt.name)
+		if endpoint != tt.endpoint || profile != tt.profile || gateway != tt.gateway {
+			t.Errorf("channelEndpoint(%q) = %q, %q, %q, want %q, %q, %q", tt.name, endpoint, profile, gateway, tt.endpoint, tt.profile, tt.gateway)
+		}
+	}
+}
+
+func TestTranscodingPtime(t *testing.T) {
+	server := newFakeServer(t)
+	c := newTestCollector(t, server, "transcoding")
+	c.PtimeCalls = 10
+	c.RecordDir = t.TempDir()
+	compareGolden(t, "transcoding_ptime", gather(t, c))
+
+	// uuid_getvar is only sent with PtimeCalls, and never recorded
+	matches, err := filepath.Glob(filepath.Join(c.recordDir(), "api_uuid_*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) > 0 {
+		t.Errorf("expected no fixture per channel, got %q", matches)
+	}
+	server = newFakeServer(t)
+	gather(t, newTestCollector(t, server, "transcoding"))
+	if i := slices.IndexFunc(server.received(), func(command string) bool { return strings.HasPrefix(command, "api uuid_getvar") }); i >= 0 {
+		t.Errorf("expected no ptime asked by default, got %q", server.received()[i])
+	}
+}
+
+func TestTranscodingPtimeErrors(t *testing.T) {
+	const command = "api uuid_getvar 00000000-0000-4000-8000-000000000102 rtp_use_codec_ptime"
+	for _, tc := range []struct {
+		name     string
+		response fakeResponse
+	}{
+		{name: "hung up", response: fakeResponse{body: "-ERR No such channel!\n"}},
+		{name: "permission denied", response: fakeResponse{body: "-ERR permission denied\n"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newFakeServer(t)
+			server.handle(command, tc.response)
+			c := newTestCollector(t, server, "transcoding")
+			c.PtimeCalls = 10
+			got := string(gather(t, c))
+			for _, want := range []string{
+				`freeswitch_scrape_collector_success{collector="transcoding"} 1`,
+				`freeswitch_bridged_calls_transcoded{a_leg_codec="G722",b_leg_codec="PCMU"} 1`,
+			} {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected %s, got:\n%s", want, got)
+				}
+			}
+			if strings.Contains(got, "freeswitch_bridged_calls_repacketized{") {
+				t.Errorf("expected no repacketized call without the ptime of the b-leg, got:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestTLS(t *testing.T) {
+	server, roots := newFakeTLSServer(t)
+	uri := "tls://" + server.listener.Addr().String()
+
+	for _, tc := range []struct {
+		name  string
+		roots *x509.CertPool
+		ok    bool
+	}{
+		{name: "trusted", roots: roots, ok: true},
+		{name: "untrusted", roots: x509.NewCertPool()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := NewCollector(uri, 5*time.Second, fakePassword, log.NewNopLogger(), namesOfCollectors()...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.TLSConfig = &tls.Config{RootCAs: tc.roots}
+
+			err = scrape(c)
+			if tc.ok && err != nil {
+				t.Fatal(err)
+			}
+			if !tc.ok && (err == nil || !strings.Contains(err.Error(), "tls handshake failed")) {
+				t.Fatalf("expected a failed handshake, got %v", err)
+			}
+		})
+	}
+	if !slices.Contains(server.received(), "auth "+fakePassword) {
+		t.Errorf("no login over tls: %q", server.received())
+	}
+}
+
+// targetValue returns the value of the gauge or counter of vec for target.
+func targetValue(t *testing.T, vec prometheus.Collector, target string) float64 {
+	t.Helper()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(vec)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			if metric.GetLabel()[0].GetValue() == target {
+				return metric.GetGauge().GetValue() + metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestPersistentReconnect(t *testing.T) {
+	server := newFakeServer(t)
+	c := newTestCollector(t, server, "memory")
+	c.Persistent = true
+	c.backoff = &backoff.Backoff{Min: 100 * time.Millisecond, Max: 100 * time.Millisecond}
+	target := c.url.String()
+
+	logins := func() int {
+		return len(slices.DeleteFunc(server.received(), func(command string) bool { return command != "auth "+fakePassword }))
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := scrape(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if logins() != 1 {
+		t.Fatalf("connection not kept across scrapes: %d logins", logins())
+	}
+	if up := targetValue(t, connectionUp, target); up != 1 {
+		t.Fatalf("expected connection up, got %v", up)
+	}
+
+	// the connection drops and the first attempt to re-establish it fails
+	server.drop()
+	server.handle("auth "+fakePassword, fakeResponse{raw: string(replyFrame("-ERR invalid"))})
+	if err := scrape(c); !errors.Is(err, ErrAuthRejected) {
+		t.Fatalf("expected %v, got %v", ErrAuthRejected, err)
+	}
+	if up := targetValue(t, connectionUp, target); up != 0 {
+		t.Fatalf("expected connection down, got %v", up)
+	}
+
+	// no attempt is made before the backoff elapsed
+	server.handle("auth "+fakePassword, fakeResponse{reply: "+OK accepted"})
+	if err := scrape(c); !errors.Is(err, ErrDisconnected) {
+		t.Fatalf("expected %v, got %v", ErrDisconnected, err)
+	}
+	if logins() != 2 {
+		t.Fatalf("reconnected within the backoff: %d logins", logins())
+	}
+
+	time.Sleep(c.backoff.Max)
+	if err := scrape(c); err != nil {
+		t.Fatal(err)
+	}
+	if up := targetValue(t, connectionUp, target); up != 1 {
+		t.Fatalf("expected connection up, got %v", up)
+	}
+	if reconnects := targetValue(t, reconnectsTotal, target); reconnects != 2 {
+		t.Errorf("expected 2 reconnects, got %v", reconnects)
+	}
+}
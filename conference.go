@@ -0,0 +1,106 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// conferenceActions are the actions of conference::maintenance events which
+// are counted, the others are ignored.
+var conferenceActions = []string{"add-member", "del-member", "conference-create", "conference-destroy", "floor-change", "mute-member"}
+
+// conferenceHandler counts the activity of the conferences by conference
+// profile, and by conference too if enabled, as there is no bound on the
+// number of rooms.
+type conferenceHandler struct {
+	rooms    bool
+	actions  *prometheus.CounterVec
+	lifetime *prometheus.HistogramVec
+	// created are the creation times of the running conferences by unique
+	// id, in microseconds, and pruned the time they were last pruned; both
+	// are only used by handle
+	created map[string]int64
+	pruned  int64
+}
+
+func newConferenceHandler(cfg *eventConfig) eventHandler {
+	labels := []string{"profile"}
+	if cfg.conferenceRooms {
+		labels = append(labels, "conference")
+	}
+	return &conferenceHandler{
+		rooms: cfg.conferenceRooms,
+		actions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "conference_events_total",
+			Help:      "Number of conference maintenance events, by action.",
+		}, append([]string{"action"}, labels...)),
+		lifetime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "conference_lifetime_seconds",
+			Help:      "Time from the creation of the conferences to their destruction.",
+			Buckets:   cfg.durationBuckets,
+		}, labels),
+		created: make(map[string]int64),
+	}
+}
+
+func (h *conferenceHandler) subscriptions() []string {
+	return []string{"CUSTOM conference::maintenance"}
+}
+
+func (h *conferenceHandler) handle(event eslEvent) {
+	action := event["Action"]
+	if !slices.Contains(conferenceActions, action) {
+		return
+	}
+
+	labels := []string{event["Conference-Profile-Name"]}
+	if h.rooms {
+		labels = append(labels, event["Conference-Name"])
+	}
+	h.actions.WithLabelValues(append([]string{action}, labels...)...).Inc()
+
+	timestamp, err := strconv.ParseInt(event["Event-Date-Timestamp"], 10, 64)
+	if err != nil {
+		return
+	}
+	h.prune(timestamp)
+	id := event["Conference-Unique-ID"]
+	switch action {
+	case "conference-create":
+		h.created[id] = timestamp
+	case "conference-destroy":
+		// conferences created before the subscription have no lifetime
+		if created, ok := h.created[id]; ok {
+			delete(h.created, id)
+			h.lifetime.WithLabelValues(labels...).Observe(float64(timestamp-created) / 1e6)
+		}
+	}
+}
+
+// prune forgets the conferences created more than stateMaxAge before now,
+// whose destruction was missed.
+func (h *conferenceHandler) prune(now int64) {
+	if now-h.pruned < statePruneTime {
+		return
+	}
+	h.pruned = now
+	for id, created := range h.created {
+		if now-created > stateMaxAge {
+			delete(h.created, id)
+		}
+	}
+}
+
+func (h *conferenceHandler) Describe(ch chan<- *prometheus.Desc) {
+	h.actions.Describe(ch)
+	h.lifetime.Describe(ch)
+}
+
+func (h *conferenceHandler) Collect(ch chan<- prometheus.Metric) {
+	h.actions.Collect(ch)
+	h.lifetime.Collect(ch)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// dial connects and authenticates a new event socket client.
+func (c *Collector) dial(ctx context.Context) error {
+	address := c.url.Host
+
+	if c.url.Scheme == "unix" {
+		address = c.url.Path
+	}
+
+	network := c.url.Scheme
+	if network == "tls" {
+		network = "tcp"
+	}
+
+	var conn net.Conn
+	var err error
+	if c.url.Scheme == "replay" {
+		conn, err = dialReplay(c.url.Path)
+	} else {
+		dialer := net.Dialer{Timeout: c.Timeout, KeepAlive: c.KeepAlive}
+		conn, err = dialer.DialContext(ctx, network, address)
+	}
+	if err != nil {
+		return err
+	}
+
+	if c.url.Scheme == "tls" {
+		tlsConn := tls.Client(conn, c.tlsConfig())
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return fmt.Errorf("tls handshake failed: %w", err)
+		}
+		conn = tlsConn
+	}
+	c.client = newESLClient(conn)
+	c.client.limit = c.MaxResponseSize
+	if c.RecordDir != "" {
+		c.client.record = c.record
+	}
+
+	if err = c.fsAuth(ctx); err != nil {
+		c.closeClient()
+		return err
+	}
+
+	return nil
+}
+
+// tlsConfig returns the TLS settings for the target, verifying its
+// certificate against the host of the URI unless a server name is configured.
+func (c *Collector) tlsConfig() *tls.Config {
+	cfg := &tls.Config{}
+	if c.TLSConfig != nil {
+		cfg = c.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = c.url.Hostname()
+	}
+	return cfg
+}
+
+// open makes c.client ready for a scrape. By default a new connection is
+// dialed every time. With Persistent the connection of the previous scrape is
+// reused, and re-established with backoff once it is lost; with a pool an
+// idle connection to the same target is taken from it if there is one.
+func (c *Collector) open(ctx context.Context) error {
+	switch {
+	case c.pool != nil:
+		return c.openPooled(ctx)
+	case c.Persistent:
+		return c.openPersistent(ctx)
+	}
+	return c.dial(ctx)
+}
+
+func (c *Collector) openPooled(ctx context.Context) error {
+	if c.client = c.pool.get(poolKey(c.url.String(), c.Username, c.Password)); c.client != nil {
+		return nil
+	}
+	return c.dial(ctx)
+}
+
+func (c *Collector) openPersistent(ctx context.Context) error {
+	target := c.url.String()
+	if c.client != nil {
+		if c.client.alive() {
+			return nil
+		}
+		level.Warn(c.logger).Log("msg", "persistent connection lost")
+		c.closeClient()
+	}
+
+	if wait := time.Until(c.nextDial); wait > 0 {
+		return fmt.Errorf("%w: next reconnect attempt in %s", ErrDisconnected, wait.Round(time.Millisecond))
+	}
+	if c.connected {
+		reconnectsTotal.WithLabelValues(target).Inc()
+	}
+
+	if err := c.dial(ctx); err != nil {
+		c.nextDial = time.Now().Add(c.backoff.Duration())
+		return err
+	}
+	c.backoff.Reset()
+	c.connected = true
+	connectionUp.WithLabelValues(target).Set(1)
+	level.Info(c.logger).Log("msg", "persistent connection established")
+	return nil
+}
+
+// release ends the use of c.client after a scrape which returned err.
+func (c *Collector) release(err error) {
+	if c.client == nil {
+		return
+	}
+	if isConnectionError(err) || (c.pool == nil && !c.Persistent) {
+		c.closeClient()
+		return
+	}
+
+	if c.pool != nil {
+		c.pool.put(poolKey(c.url.String(), c.Username, c.Password), c.client)
+		c.client = nil
+	}
+}
+
+func (c *Collector) closeClient() {
+	if c.client == nil {
+		return
+	}
+	c.client.Close()
+	c.client = nil
+	if c.Persistent {
+		connectionUp.WithLabelValues(c.url.String()).Set(0)
+	}
+}
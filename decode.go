@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/net/html/charset"
+)
+
+// decodeXMLRows decodes the elements called name of the XML document read
+// from r one at a time, and calls fn with each of them. Only a single row is
+// held in memory, whatever the size of the document.
+func decodeXMLRows[T any](r io.Reader, name string, fn func(*T) error) error {
+	decoder := xml.NewDecoder(r)
+	decoder.CharsetReader = charset.NewReaderLabel
+
+	document := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			if !document {
+				return errors.New("no XML document")
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		document = true
+		if start.Name.Local != name {
+			continue
+		}
+
+		var row T
+		if err = decoder.DecodeElement(&row, &start); err != nil {
+			return err
+		}
+		if err = fn(&row); err != nil {
+			return err
+		}
+	}
+}
+
+// decodeJSONRows reads the output of a "show ... as json" command from r and
+// returns its row_count. Each object of its rows array is decoded one at a
+// time and passed to fn; without fn the rows are skipped, and reading stops
+// as soon as the count is known.
+func decodeJSONRows[T any](r io.Reader, fn func(*T) error) (float64, error) {
+	decoder := json.NewDecoder(r)
+	if err := expectDelim(decoder, '{'); err != nil {
+		return 0, err
+	}
+
+	var count float64
+	counted := false
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return 0, err
+		}
+
+		switch token {
+		case "row_count":
+			if err = decoder.Decode(&count); err != nil {
+				return 0, err
+			}
+			counted = true
+		case "rows":
+			if fn == nil && counted {
+				return count, nil
+			}
+			if err = expectDelim(decoder, '['); err != nil {
+				return 0, err
+			}
+			for decoder.More() {
+				if fn == nil {
+					var skip json.RawMessage
+					err = decoder.Decode(&skip)
+				} else {
+					var row T
+					if err = decoder.Decode(&row); err == nil {
+						err = fn(&row)
+					}
+				}
+				if err != nil {
+					return 0, err
+				}
+			}
+			if err = expectDelim(decoder, ']'); err != nil {
+				return 0, err
+			}
+		default:
+			var skip json.RawMessage
+			if err = decoder.Decode(&skip); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if !counted {
+		return 0, errors.New("missing row_count")
+	}
+	return count, nil
+}
+
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("expected %q, got %v", delim, token)
+	}
+	return nil
+}
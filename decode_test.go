@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDecodeJSONRows(t *testing.T) {
+	type row struct {
+		UUID string `json:"uuid"`
+	}
+
+	for _, tc := range []struct {
+		name  string
+		input string
+		count float64
+		uuids []string
+		err   bool
+	}{
+		{name: "count only", input: `{"row_count":0}`},
+		{name: "rows", input: `{"row_count":2,"rows":[{"uuid":"a","x":[1]},{"uuid":"b"}]}`, count: 2, uuids: []string{"a", "b"}},
+		{name: "count after rows", input: `{"rows":[{"uuid":"a"}],"row_count":1}`, count: 1, uuids: []string{"a"}},
+		{name: "missing count", input: `{"rows":[]}`, err: true},
+		{name: "not an object", input: `-ERR no reply`, err: true},
+		{name: "truncated rows", input: `{"row_count":2,"rows":[{"uuid":"a"},{"uu`, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var uuids []string
+			count, err := decodeJSONRows(strings.NewReader(tc.input), func(r *row) error {
+				uuids = append(uuids, r.UUID)
+				return nil
+			})
+			if (err != nil) != tc.err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err == nil && (count != tc.count || !slices.Equal(uuids, tc.uuids)) {
+				t.Errorf("got %v rows %q, want %v rows %q", count, uuids, tc.count, tc.uuids)
+			}
+		})
+	}
+}
+
+func TestDecodeJSONRowsStopsAtRows(t *testing.T) {
+	// rows are not read once the count is known, broken ones included
+	count, err := decodeJSONRows[json.RawMessage](strings.NewReader(`{"row_count":3,"rows":[{"uu`), nil)
+	if err != nil || count != 3 {
+		t.Errorf("got %v, %v", count, err)
+	}
+}
+
+func TestDecodeXMLRows(t *testing.T) {
+	var names []string
+	err := decodeXMLRows(strings.NewReader(`<?xml version="1.0" encoding="ISO-8859-1"?>
+<result row_count="2"><row row_id="1"><name>caf`+"\xe9"+`</name></row><row row_id="2"><name>sofia</name></row></result>`),
+		"row", func(r *ResultRow) error {
+			names = append(names, r.Name.Text)
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"café", "sofia"}; !slices.Equal(names, want) {
+		t.Errorf("got %q, want %q", names, want)
+	}
+
+	for _, input := range []string{"", "+OK\n", "<result><row>"} {
+		if err = decodeXMLRows(strings.NewReader(input), "row", func(*ResultRow) error { return nil }); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
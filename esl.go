@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Error classes returned by the event socket client. They are meant to be
+// checked with errors.Is, the returned errors carry more context.
+var (
+	// ErrCommandNotFound is returned when FreeSWITCH does not know the command,
+	// usually because the module providing it is not loaded.
+	ErrCommandNotFound = errors.New("command not found")
+	// ErrPermissionDenied is returned when the command is not allowed for the
+	// authenticated user.
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrCommandFailed is returned for any other -ERR reply.
+	ErrCommandFailed = errors.New("command failed")
+	// ErrAuthRejected is returned when FreeSWITCH refuses the credentials or
+	// the connection itself (ACL).
+	ErrAuthRejected = errors.New("auth rejected")
+	// ErrDisconnected is returned when FreeSWITCH closed the connection.
+	ErrDisconnected = errors.New("disconnected")
+	// ErrMalformedFrame is returned when a frame cannot be parsed.
+	ErrMalformedFrame = errors.New("malformed frame")
+	// ErrResponseTooLarge is returned when a frame exceeds the maximum
+	// response size. Its body is not read, so the connection is given up.
+	ErrResponseTooLarge = errors.New("response too large")
+)
+
+// ReplyError is an -ERR reply to a command. It unwraps to one of the error classes above.
+type ReplyError struct {
+	Command string
+	Reply   string
+	Err     error
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Command, e.Reply)
+}
+
+func (e *ReplyError) Unwrap() error {
+	return e.Err
+}
+
+func newReplyError(command, reply string) *ReplyError {
+	reply = strings.TrimSpace(reply)
+	lower := strings.ToLower(reply)
+
+	class := ErrCommandFailed
+	switch {
+	case strings.Contains(lower, "command not found"):
+		class = ErrCommandNotFound
+	case strings.Contains(lower, "permission denied"):
+		class = ErrPermissionDenied
+	}
+	return &ReplyError{Command: command, Reply: reply, Err: class}
+}
+
+// eslFrame is a single message read from the event socket: a MIME header block
+// followed by an optional body of Content-Length bytes.
+type eslFrame struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+func (f *eslFrame) contentType() string {
+	return f.header.Get("Content-Type")
+}
+
+// eslEvent holds the headers of an event received as text/event-json, its
+// body is kept in the "_body" header.
+type eslEvent map[string]string
+
+func parseEvent(data []byte) (eslEvent, error) {
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%w: cannot parse event: %w", ErrMalformedFrame, err)
+	}
+
+	// array headers are not used, only keep the plain ones
+	event := make(eslEvent, len(raw))
+	for key, value := range raw {
+		if s, ok := value.(string); ok {
+			event[key] = s
+		}
+	}
+	return event, nil
+}
+
+// eslClient speaks the mod_event_socket inbound protocol over a single connection.
+type eslClient struct {
+	conn  net.Conn
+	input *bufio.Reader
+	// limit is the maximum size of a frame body, 0 means unlimited
+	limit int64
+	// record, if set, is called with every command and the frame answering it
+	record func(command string, frame *eslFrame)
+}
+
+func newESLClient(conn net.Conn) *eslClient {
+	return &eslClient{
+		conn:  conn,
+		input: bufio.NewReader(conn),
+	}
+}
+
+func (e *eslClient) Close() error {
+	return e.conn.Close()
+}
+
+func (e *eslClient) readFrame() (*eslFrame, error) {
+	return readFrame(e.input, e.limit)
+}
+
+// readFrame reads a whole frame, refusing bodies larger than limit unless it is 0.
+func readFrame(input *bufio.Reader, limit int64) (*eslFrame, error) {
+	frame, length, err := readHeader(input, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	frame.body = make([]byte, length)
+	if _, err = io.ReadFull(input, frame.body); err != nil {
+		return nil, readError(err)
+	}
+	return frame, nil
+}
+
+// readHeader reads the header block of a frame and returns the length of
+// the body following it, which is left to the caller.
+func readHeader(input *bufio.Reader, limit int64) (*eslFrame, int64, error) {
+	header, err := textproto.NewReader(input).ReadMIMEHeader()
+	if err != nil {
+		return nil, 0, readError(err)
+	}
+
+	frame := &eslFrame{header: header}
+	if frame.contentType() == "" {
+		return nil, 0, fmt.Errorf("%w: missing header 'Content-Type'", ErrMalformedFrame)
+	}
+
+	var length int64
+	if value := header.Get("Content-Length"); value != "" {
+		length, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || length < 0 {
+			return nil, 0, fmt.Errorf("%w: invalid header 'Content-Length: %s'", ErrMalformedFrame, value)
+		}
+		if limit > 0 && length > limit {
+			return nil, 0, fmt.Errorf("%w: %s of %d bytes exceeds the limit of %d bytes",
+				ErrResponseTooLarge, frame.contentType(), length, limit)
+		}
+	}
+
+	return frame, length, nil
+}
+
+// readError classifies errors of the underlying connection.
+func readError(err error) error {
+	var protoErr textproto.ProtocolError
+	switch {
+	case errors.As(err, &protoErr):
+		return fmt.Errorf("%w: %w", ErrMalformedFrame, err)
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, net.ErrClosed), errors.Is(err, syscall.ECONNRESET):
+		return fmt.Errorf("%w: %w", ErrDisconnected, err)
+	}
+	return err
+}
+
+// isConnectionError reports whether err leaves the connection unusable, as
+// opposed to errors of a single command or of parsing its reply.
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, ErrDisconnected) || errors.Is(err, ErrMalformedFrame) ||
+		errors.Is(err, ErrResponseTooLarge) || errors.Is(err, context.Canceled) || errors.As(err, &netErr)
+}
+
+// bind applies the deadline of ctx to the connection and aborts pending I/O
+// once ctx is cancelled. The returned function has to be called when done.
+// A cancelled exchange leaves the connection unusable.
+func (e *eslClient) bind(ctx context.Context) (stop func() bool) {
+	deadline, _ := ctx.Deadline()
+	e.conn.SetDeadline(deadline)
+	return context.AfterFunc(ctx, func() {
+		e.conn.SetDeadline(time.Now())
+	})
+}
+
+// contextError prefers the error of ctx over err if ctx caused it.
+func contextError(ctx context.Context, err error) error {
+	if !expired(ctx) {
+		return err
+	}
+	cause := ctx.Err()
+	if cause == nil {
+		cause = context.DeadlineExceeded
+	}
+	return fmt.Errorf("%w: %w", cause, err)
+}
+
+// expired reports whether ctx is done. The deadline of the connection may
+// pass just before ctx notices, so that counts as well.
+func expired(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	return ctx.Err() != nil || ok && !time.Now().Before(deadline)
+}
+
+// alive reports whether an idle connection can still be used, without
+// blocking. Events sent in the meantime are discarded, anything else (e.g. a
+// disconnect notice) or a closed socket means the connection is gone.
+func (e *eslClient) alive() bool {
+	defer e.conn.SetReadDeadline(time.Time{})
+
+	for {
+		e.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+		if _, err := e.input.Peek(1); err != nil {
+			var netErr net.Error
+			return errors.As(err, &netErr) && netErr.Timeout()
+		}
+
+		// something was sent while idle, read the whole frame
+		e.conn.SetReadDeadline(time.Now().Add(time.Second))
+		frame, err := e.readFrame()
+		if err != nil || !strings.HasPrefix(frame.contentType(), "text/event-") {
+			return false
+		}
+	}
+}
+
+// command sends command and returns the body of its reply.
+func (e *eslClient) command(ctx context.Context, command string) ([]byte, error) {
+	var body []byte
+	err := e.stream(ctx, command, func(r io.Reader) (err error) {
+		body, err = io.ReadAll(r)
+		return err
+	})
+	return body, err
+}
+
+// stream sends command and calls decode with a reader of the body of its
+// reply. An api/response body is read from the connection while decode
+// consumes it, instead of being loaded at once. Event frames received in
+// between are skipped.
+func (e *eslClient) stream(ctx context.Context, command string, decode func(io.Reader) error) error {
+	stop := e.bind(ctx)
+	defer stop()
+
+	_, err := io.WriteString(e.conn, command+"\n\n")
+	if err != nil {
+		return fmt.Errorf("cannot write command: %w", contextError(ctx, readError(err)))
+	}
+
+	for {
+		frame, length, err := readHeader(e.input, e.limit)
+		if err != nil {
+			return fmt.Errorf("cannot read command response: %w", contextError(ctx, err))
+		}
+
+		contentType := frame.contentType()
+		if contentType == "api/response" && e.record == nil {
+			return e.decodeBody(ctx, command, length, decode)
+		}
+
+		frame.body = make([]byte, length)
+		if _, err = io.ReadFull(e.input, frame.body); err != nil {
+			return fmt.Errorf("cannot read command response: %w", contextError(ctx, readError(err)))
+		}
+
+		if e.record != nil && (contentType == "api/response" || contentType == "command/reply") {
+			e.record(command, frame)
+		}
+
+		switch contentType {
+		case "api/response":
+			if bytes.HasPrefix(frame.body, []byte("-ERR")) {
+				return newReplyError(command, string(frame.body))
+			}
+			return decode(bytes.NewReader(frame.body))
+		case "command/reply":
+			reply := frame.header.Get("Reply-Text")
+			if strings.HasPrefix(reply, "-ERR") {
+				return newReplyError(command, reply)
+			}
+			return decode(strings.NewReader(reply))
+		case "text/disconnect-notice":
+			return fmt.Errorf("%w: %s", ErrDisconnected, strings.TrimSpace(string(frame.body)))
+		case "text/rude-rejection":
+			return fmt.Errorf("%w: %s", ErrAuthRejected, strings.TrimSpace(string(frame.body)))
+		default:
+			if strings.HasPrefix(contentType, "text/event-") {
+				continue
+			}
+			return fmt.Errorf("%w: unexpected content-type %q", ErrMalformedFrame, contentType)
+		}
+	}
+}
+
+// decodeBody passes the api/response body of length bytes waiting on the
+// connection to decode, and skips what decode left so that the next frame
+// can be read.
+func (e *eslClient) decodeBody(ctx context.Context, command string, length int64, decode func(io.Reader) error) error {
+	body := &bodyReader{r: &io.LimitedReader{R: e.input, N: length}}
+
+	prefix, err := e.input.Peek(int(min(length, 4)))
+	if err != nil {
+		return fmt.Errorf("cannot read command response: %w", contextError(ctx, readError(err)))
+	}
+	if bytes.Equal(prefix, []byte("-ERR")) {
+		reply, err := io.ReadAll(body)
+		if err != nil {
+			return fmt.Errorf("cannot read command response: %w", contextError(ctx, readError(err)))
+		}
+		return newReplyError(command, string(reply))
+	}
+
+	err = decode(body)
+	io.Copy(io.Discard, body)
+	if body.err != nil {
+		// decode failed because of the connection rather than the content
+		return fmt.Errorf("cannot read command response: %w", contextError(ctx, readError(body.err)))
+	}
+	return err
+}
+
+// bodyReader reads a body from the connection and keeps the first error of
+// doing so, a body cut short included.
+type bodyReader struct {
+	r   *io.LimitedReader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err == io.EOF && b.r.N > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+	}
+	return n, err
+}
+
+// auth waits for the auth request sent by FreeSWITCH on connect and answers
+// it. Without user the shared event socket password is used, otherwise the
+// directory user (user@domain) logs in with userauth.
+func (e *eslClient) auth(ctx context.Context, user, password string) error {
+	stop := e.bind(ctx)
+	defer stop()
+
+	frame, err := e.readFrame()
+	if err != nil {
+		return fmt.Errorf("read auth failed: %w", contextError(ctx, err))
+	}
+
+	switch frame.contentType() {
+	case "auth/request":
+	case "text/rude-rejection":
+		return fmt.Errorf("auth failed: %w: %s", ErrAuthRejected, strings.TrimSpace(string(frame.body)))
+	default:
+		return fmt.Errorf("auth failed: %w: unexpected content-type %q", ErrMalformedFrame, frame.contentType())
+	}
+
+	command := fmt.Sprintf("auth %s\n\n", password)
+	if user != "" {
+		command = fmt.Sprintf("userauth %s:%s\n\n", user, password)
+	}
+	_, err = io.WriteString(e.conn, command)
+	if err != nil {
+		return fmt.Errorf("write auth failed: %w", contextError(ctx, readError(err)))
+	}
+
+	frame, err = e.readFrame()
+	if err != nil {
+		return fmt.Errorf("read auth failed: %w", contextError(ctx, err))
+	}
+
+	if frame.contentType() != "command/reply" {
+		return fmt.Errorf("auth failed: %w: unexpected content-type %q", ErrMalformedFrame, frame.contentType())
+	}
+
+	if reply := frame.header.Get("Reply-Text"); reply != "+OK accepted" {
+		return fmt.Errorf("auth failed: %w: %s", ErrAuthRejected, reply)
+	}
+
+	return nil
+}
+
+// connect starts an outbound event socket session, on a connection made by
+// the socket application of the dialplan, and returns the data of the
+// channel sent in reply.
+func (e *eslClient) connect(ctx context.Context) (textproto.MIMEHeader, error) {
+	stop := e.bind(ctx)
+	defer stop()
+
+	if _, err := io.WriteString(e.conn, "connect\n\n"); err != nil {
+		return nil, fmt.Errorf("write connect failed: %w", contextError(ctx, readError(err)))
+	}
+
+	frame, err := e.readFrame()
+	if err != nil {
+		return nil, fmt.Errorf("read connect failed: %w", contextError(ctx, err))
+	}
+	if frame.contentType() != "command/reply" {
+		return nil, fmt.Errorf("connect failed: %w: unexpected content-type %q", ErrMalformedFrame, frame.contentType())
+	}
+
+	// the values of the channel data are URL encoded
+	channel := make(textproto.MIMEHeader, len(frame.header))
+	for key, values := range frame.header {
+		value, err := url.PathUnescape(values[0])
+		if err != nil {
+			value = values[0]
+		}
+		channel.Set(key, value)
+	}
+	return channel, nil
+}
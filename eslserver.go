@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+// eslHandler answers a command received by serveESL with the frames to send
+// back. Returning false closes the connection after sending them.
+type eslHandler func(command string, header textproto.MIMEHeader) ([]byte, bool)
+
+// serveESL plays the FreeSWITCH side of an inbound event socket connection:
+// it requests authentication and answers commands with handle. bgapi jobs
+// are answered with the response handle gives to the api command, "exit"
+// closes the connection.
+func serveESL(conn net.Conn, handle eslHandler) {
+	defer conn.Close()
+
+	input := textproto.NewReader(bufio.NewReader(conn))
+	if _, err := io.WriteString(conn, "Content-Type: auth/request\n\n"); err != nil {
+		return
+	}
+
+	for {
+		command, header, err := readCommand(input)
+		if err != nil {
+			return
+		}
+
+		var response []byte
+		keep := true
+		switch name, args, _ := strings.Cut(command, " "); name {
+		case "bgapi":
+			response, keep = handle("api "+args, header)
+			response = backgroundJobFrames(header.Get("Job-UUID"), response)
+		case "exit":
+			response, keep = replyFrame("+OK bye"), false
+		default:
+			response, keep = handle(command, header)
+		}
+
+		if _, err = conn.Write(response); err != nil || !keep {
+			return
+		}
+	}
+}
+
+// readCommand reads a command line and the headers following it.
+func readCommand(input *textproto.Reader) (string, textproto.MIMEHeader, error) {
+	var command string
+	for command == "" {
+		line, err := input.ReadLine()
+		if err != nil {
+			return "", nil, err
+		}
+		command = strings.TrimSpace(line)
+	}
+
+	header, err := input.ReadMIMEHeader()
+	if err != nil {
+		return "", nil, err
+	}
+	return command, header, nil
+}
+
+// backgroundJobFrames answers a bgapi command with the api frame that was
+// recorded for it: a reply acknowledging the job, followed by its result.
+func backgroundJobFrames(job string, raw []byte) []byte {
+	frame, err := readFrame(bufio.NewReader(bytes.NewReader(raw)), 0)
+	if err != nil {
+		return replyFrame("-ERR " + err.Error())
+	}
+	if frame.contentType() != "api/response" {
+		// e.g. -ERR permission denied, which refuses the job itself
+		return raw
+	}
+
+	event, _ := json.Marshal(map[string]string{
+		"Event-Name": "BACKGROUND_JOB",
+		"Job-UUID":   job,
+		"_body":      string(frame.body),
+	})
+	return append(replyFrame("+OK Job-UUID: "+job), encodeFrame(&eslFrame{
+		header: textproto.MIMEHeader{"Content-Type": {"text/event-json"}},
+		body:   event,
+	})...)
+}
+
+func replyFrame(text string) []byte {
+	return encodeFrame(&eslFrame{header: textproto.MIMEHeader{
+		"Content-Type": {"command/reply"},
+		"Reply-Text":   {text},
+	}})
+}
+
+func apiFrame(body string) []byte {
+	return encodeFrame(&eslFrame{
+		header: textproto.MIMEHeader{"Content-Type": {"api/response"}},
+		body:   []byte(body),
+	})
+}
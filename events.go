@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/jpillora/backoff"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// eventHandler keeps metrics built from the events it handles, which it
+// exposes as a prometheus.Collector. handle and Collect may run concurrently.
+type eventHandler interface {
+	prometheus.Collector
+	// subscriptions returns the events the handler needs, custom events as
+	// "CUSTOM <subclass>".
+	subscriptions() []string
+	handle(event eslEvent)
+}
+
+// eventConfig holds the settings of the event handlers.
+type eventConfig struct {
+	// durationBuckets are the buckets of call durations, in seconds
+	durationBuckets []float64
+	// setupBuckets are the buckets of call setup times, in seconds
+	setupBuckets []float64
+	// heartbeatMaxAge is the age above which the last HEARTBEAT event is no
+	// longer used by the status collector
+	heartbeatMaxAge time.Duration
+	// conferenceRooms adds the name of the conference to its metrics
+	conferenceRooms bool
+	// recordingContexts are the contexts where answered calls have to be
+	// recorded
+	recordingContexts []string
+}
+
+// stateMaxAge is the age, in microseconds like the Event-Date-Timestamp of
+// the events, above which the handlers forget a conference or a recording
+// whose end was never seen, e.g. as the event was dropped or sent while the
+// subscriber was reconnecting. They are checked at most every hour.
+const (
+	stateMaxAge    = int64(24 * time.Hour / time.Microsecond)
+	statePruneTime = int64(time.Hour / time.Microsecond)
+)
+
+// defaultDurationBuckets range from short calls to an hour.
+const defaultDurationBuckets = "5,15,30,60,120,300,600,1200,1800,3600"
+
+// defaultSetupBuckets range from an immediate answer to a minute of ringing.
+const defaultSetupBuckets = "0.5,1,2,3,5,8,13,20,30,60"
+
+// parseBuckets converts a comma separated list of histogram buckets.
+func parseBuckets(list string) ([]float64, error) {
+	var buckets []float64
+	for _, field := range strings.Split(list, ",") {
+		bucket, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %q: %w", field, err)
+		}
+		if len(buckets) > 0 && bucket <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("buckets %q are not in increasing order", list)
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, nil
+}
+
+var eventHandlers = []struct {
+	name string
+	new  func(cfg *eventConfig) eventHandler
+}{
+	{"hangup", newHangupHandler},
+	{"duration", newDurationHandler},
+	{"setup", newSetupHandler},
+	{"gateway_calls", newGatewayCallsHandler},
+	{"heartbeat", newHeartbeatHandler},
+	{"registration", newRegistrationHandler},
+	{"gateway_state", newGatewayStateHandler},
+	{"conference", newConferenceHandler},
+	{"recordings", newRecordingsHandler},
+}
+
+func namesOfEventHandlers() []string {
+	var ret []string
+	for i := range eventHandlers {
+		ret = append(ret, eventHandlers[i].name)
+	}
+	return ret
+}
+
+// eventKey returns the name an event is subscribed and counted by.
+func eventKey(event eslEvent) string {
+	if name := event["Event-Name"]; name != "CUSTOM" {
+		return name
+	}
+	return "CUSTOM " + event["Event-Subclass"]
+}
+
+// eventSubscriber keeps a connection subscribed to events in the
+// background, and passes the events received to the handlers through a
+// bounded queue. Events arriving while the queue is full are dropped.
+type eventSubscriber struct {
+	// conn connects with the settings of the scrape target, it is not used
+	// to scrape
+	conn     *Collector
+	filters  []string
+	events   []string
+	handlers map[string][]eventHandler
+	queue    chan eslEvent
+	backoff  *backoff.Backoff
+	logger   log.Logger
+}
+
+func newEventSubscriber(conn *Collector, cfg *eventConfig, events, filters []string, queueSize int, logger log.Logger, disables ...string) (*eventSubscriber, error) {
+	for _, filter := range filters {
+		if header, value, ok := strings.Cut(filter, " "); !ok || header == "" || value == "" {
+			return nil, fmt.Errorf("invalid event filter %q, expected \"<header> <value>\"", filter)
+		}
+	}
+
+	s := &eventSubscriber{
+		conn:     conn,
+		filters:  filters,
+		handlers: make(map[string][]eventHandler),
+		queue:    make(chan eslEvent, queueSize),
+		backoff: &backoff.Backoff{
+			Min:    time.Second,
+			Max:    time.Minute,
+			Jitter: true,
+		},
+		logger: logger,
+	}
+	for _, event := range events {
+		s.subscribe(event)
+	}
+	for i := range eventHandlers {
+		if slices.Contains(disables, eventHandlers[i].name) {
+			continue
+		}
+		handler := eventHandlers[i].new(cfg)
+		for _, event := range handler.subscriptions() {
+			s.subscribe(event)
+			s.handlers[event] = append(s.handlers[event], handler)
+		}
+	}
+	if len(s.events) == 0 {
+		return nil, errors.New("no events to subscribe to")
+	}
+	return s, nil
+}
+
+func (s *eventSubscriber) subscribe(event string) {
+	if !slices.Contains(s.events, event) {
+		s.events = append(s.events, event)
+	}
+}
+
+// collectors returns the handlers, to be registered next to the collectors.
+func (s *eventSubscriber) collectors() []prometheus.Collector {
+	var ret []prometheus.Collector
+	for _, handlers := range s.handlers {
+		for _, handler := range handlers {
+			if !slices.Contains(ret, prometheus.Collector(handler)) {
+				ret = append(ret, handler)
+			}
+		}
+	}
+	return ret
+}
+
+// heartbeat returns the heartbeat handler, or nil if it is disabled.
+func (s *eventSubscriber) heartbeat() *heartbeatHandler {
+	for _, handler := range s.handlers["HEARTBEAT"] {
+		if h, ok := handler.(*heartbeatHandler); ok {
+			return h
+		}
+	}
+	return nil
+}
+
+// command returns the event json command subscribing to the events, with
+// the subclasses of custom events listed after CUSTOM.
+func (s *eventSubscriber) command() string {
+	var names, subclasses []string
+	for _, event := range s.events {
+		if subclass, ok := strings.CutPrefix(event, "CUSTOM "); ok {
+			subclasses = append(subclasses, subclass)
+		} else {
+			names = append(names, event)
+		}
+	}
+	if len(subclasses) > 0 {
+		names = append(names, "CUSTOM")
+		names = append(names, subclasses...)
+	}
+	return "event json " + strings.Join(names, " ")
+}
+
+// run keeps the subscription until ctx is cancelled, reconnecting with
+// backoff whenever the connection is lost.
+func (s *eventSubscriber) run(ctx context.Context) {
+	go s.dispatch(ctx)
+
+	for {
+		err := s.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		wait := s.backoff.Duration()
+		level.Warn(s.logger).Log("msg", "event subscription lost", "retry_in", wait, "err", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		eventReconnectsTotal.Inc()
+	}
+}
+
+// listen connects, subscribes and queues the events received until the
+// connection fails.
+func (s *eventSubscriber) listen(ctx context.Context) error {
+	setupCtx, cancel := context.WithTimeout(ctx, s.conn.Timeout)
+	defer cancel()
+
+	if err := s.conn.dial(setupCtx); err != nil {
+		return err
+	}
+	client := s.conn.client
+	defer s.conn.closeClient()
+
+	for _, filter := range s.filters {
+		if _, err := client.command(setupCtx, "filter "+filter); err != nil {
+			return err
+		}
+	}
+	if _, err := client.command(setupCtx, s.command()); err != nil {
+		return err
+	}
+
+	// events may not arrive for a long time, a dead connection is found by
+	// the TCP keepalive instead
+	client.conn.SetDeadline(time.Time{})
+	stop := context.AfterFunc(ctx, func() {
+		client.conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	s.backoff.Reset()
+	eventConnectionUp.Set(1)
+	defer eventConnectionUp.Set(0)
+	level.Info(s.logger).Log("msg", "subscribed to events", "events", strings.Join(s.events, ","))
+
+	for {
+		frame, err := client.readFrame()
+		if err != nil {
+			return contextError(ctx, err)
+		}
+
+		switch frame.contentType() {
+		case "text/event-json":
+			event, err := parseEvent(frame.body)
+			if err != nil {
+				return err
+			}
+			s.enqueue(event)
+		case "text/disconnect-notice":
+			return fmt.Errorf("%w: %s", ErrDisconnected, strings.TrimSpace(string(frame.body)))
+		}
+	}
+}
+
+func (s *eventSubscriber) enqueue(event eslEvent) {
+	eventsReceived.WithLabelValues(eventKey(event)).Inc()
+	select {
+	case s.queue <- event:
+		eventQueueLength.Set(float64(len(s.queue)))
+	default:
+		eventsDropped.Inc()
+	}
+}
+
+// dispatch passes the queued events to the handlers.
+func (s *eventSubscriber) dispatch(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-s.queue:
+			eventQueueLength.Set(float64(len(s.queue)))
+			if timestamp, err := strconv.ParseInt(event["Event-Date-Timestamp"], 10, 64); err == nil {
+				eventLag.Observe(time.Since(time.UnixMicro(timestamp)).Seconds())
+			}
+			for _, handler := range s.handlers[eventKey(event)] {
+				handler.handle(event)
+			}
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// recordingHandler passes the events it handles on to a channel.
+type recordingHandler struct {
+	prometheus.Collector
+	events []string
+	ch     chan eslEvent
+}
+
+func (h *recordingHandler) subscriptions() []string { return h.events }
+func (h *recordingHandler) handle(event eslEvent)   { h.ch <- event }
+
+// newTestSubscriber returns a subscriber to server, with handler if not nil.
+func newTestSubscriber(t *testing.T, server *fakeServer, handler eventHandler, events ...string) *eventSubscriber {
+	t.Helper()
+
+	conn, err := NewCollector(server.uri(), 5*time.Second, fakePassword, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newEventSubscriber(conn, testEventConfig(t), events, []string{"Event-Name HEARTBEAT"}, 10, log.NewNopLogger(), namesOfEventHandlers()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handler != nil {
+		for _, event := range handler.subscriptions() {
+			s.subscribe(event)
+			s.handlers[event] = append(s.handlers[event], handler)
+		}
+	}
+	s.backoff.Min = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go s.run(ctx)
+	server.subscribed()
+	return s
+}
+
+func receive(t *testing.T, ch <-chan eslEvent) eslEvent {
+	t.Helper()
+
+	select {
+	case event := <-ch:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event handled")
+		return nil
+	}
+}
+
+func TestEventSubscriber(t *testing.T) {
+	server := newFakeServer(t)
+	handler := &recordingHandler{events: []string{"HEARTBEAT", "CUSTOM sofia::register"}, ch: make(chan eslEvent, 10)}
+	newTestSubscriber(t, server, handler, "CHANNEL_CREATE")
+
+	commands := server.received()
+	if !slices.Contains(commands, "filter Event-Name HEARTBEAT") {
+		t.Errorf("filter not set: %q", commands)
+	}
+	if want := "event json CHANNEL_CREATE HEARTBEAT CUSTOM sofia::register"; !slices.Contains(commands, want) {
+		t.Errorf("expected %q, got %q", want, commands)
+	}
+
+	server.publish(map[string]string{"Event-Name": "CHANNEL_CREATE"})
+	server.publish(map[string]string{"Event-Name": "CUSTOM", "Event-Subclass": "sofia::register", "profile-name": "internal"})
+	if event := receive(t, handler.ch); event["profile-name"] != "internal" {
+		t.Errorf("unexpected event %v", event)
+	}
+
+	// the subscription survives losing the connection
+	server.drop()
+	server.subscribed()
+	server.publish(map[string]string{"Event-Name": "HEARTBEAT", "Session-Count": "3"})
+	if event := receive(t, handler.ch); event["Session-Count"] != "3" {
+		t.Errorf("unexpected event %v", event)
+	}
+}
+
+func TestEventSubscriberDrops(t *testing.T) {
+	server := newFakeServer(t)
+	// the handler blocks, so the queue of 10 fills up
+	handler := &recordingHandler{events: []string{"HEARTBEAT"}, ch: make(chan eslEvent)}
+	newTestSubscriber(t, server, handler, "HEARTBEAT")
+
+	before := eventsDroppedValue(t)
+	for range 20 {
+		server.publish(map[string]string{"Event-Name": "HEARTBEAT"})
+	}
+	for start := time.Now(); eventsDroppedValue(t)-before < 9; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("expected at least 9 dropped events, got %v", eventsDroppedValue(t)-before)
+		}
+	}
+}
+
+func eventsDroppedValue(t *testing.T) float64 {
+	t.Helper()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == namespace+"_exporter_events_dropped_total" {
+			return family.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestEventSubscriberConfig(t *testing.T) {
+	conn, err := NewCollector("tcp://localhost:8021", time.Second, fakePassword, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = newEventSubscriber(conn, &eventConfig{}, []string{"HEARTBEAT"}, []string{"Caller-Context"}, 10, log.NewNopLogger()); err == nil {
+		t.Error("expected error for filter without value")
+	}
+	if _, err = newEventSubscriber(conn, &eventConfig{}, nil, nil, 10, log.NewNopLogger(), namesOfEventHandlers()...); err == nil {
+		t.Error("expected error without events")
+	}
+}
+
+// testEventConfig returns the default settings of the event handlers.
+func testEventConfig(t *testing.T) *eventConfig {
+	t.Helper()
+
+	durationBuckets, err := parseBuckets(defaultDurationBuckets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupBuckets, err := parseBuckets(defaultSetupBuckets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &eventConfig{
+		durationBuckets:   durationBuckets,
+		setupBuckets:      setupBuckets,
+		heartbeatMaxAge:   time.Minute,
+		recordingContexts: []string{"default", "public"},
+	}
+}
+
+func TestParseBuckets(t *testing.T) {
+	buckets, err := parseBuckets("0.5, 1,10")
+	if err != nil || !slices.Equal(buckets, []float64{0.5, 1, 10}) {
+		t.Errorf("got %v, %v", buckets, err)
+	}
+	for _, list := range []string{"", "1,x", "10,5", "1,1"} {
+		if _, err = parseBuckets(list); err == nil {
+			t.Errorf("expected error for %q", list)
+		}
+	}
+}
+
+// loadEvents returns the events of testdata/events/*.json, in order of time.
+func loadEvents(t *testing.T) []eslEvent {
+	t.Helper()
+
+	files, err := filepath.Glob("testdata/events/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []eslEvent
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var raw []json.RawMessage
+		if err = json.Unmarshal(data, &raw); err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		for _, r := range raw {
+			event, err := parseEvent(r)
+			if err != nil {
+				t.Fatalf("%s: %v", file, err)
+			}
+			events = append(events, event)
+		}
+	}
+	slices.SortStableFunc(events, func(a, b eslEvent) int {
+		return strings.Compare(a["Event-Date-Timestamp"], b["Event-Date-Timestamp"])
+	})
+	return events
+}
+
+func TestEventHandlersGolden(t *testing.T) {
+	events := loadEvents(t)
+
+	for _, def := range eventHandlers {
+		t.Run(def.name, func(t *testing.T) {
+			handler := def.new(testEventConfig(t))
+			subscriptions := handler.subscriptions()
+			for _, event := range events {
+				if slices.Contains(subscriptions, eventKey(event)) {
+					handler.handle(event)
+				}
+			}
+			var c prometheus.Collector = handler
+			if heartbeat, ok := handler.(*heartbeatHandler); ok {
+				c = heartbeatCollector{heartbeat}
+			}
+			compareGolden(t, filepath.Join("events", def.name), gather(t, c))
+		})
+	}
+}
+
+// heartbeatCollector adds the status metrics taken from the last heartbeat
+// to those of the handler.
+type heartbeatCollector struct {
+	*heartbeatHandler
+}
+
+func (c heartbeatCollector) Collect(ch chan<- prometheus.Metric) {
+	c.heartbeatHandler.Collect(ch)
+	if event := c.latest(); event != nil {
+		heartbeatMetrics(event, nil, ch)
+	}
+}
+
+func TestGatewayName(t *testing.T) {
+	tests := []struct {
+		event eslEvent
+		want  string
+	}{
+		{eslEvent{"variable_sip_gateway_name": "carrier-a", "Channel-Name": "sofia/gateway/carrier-b/1000"}, "carrier-a"},
+		{eslEvent{"Channel-Name": "sofia/gateway/carrier-b/15551230000"}, "carrier-b"},
+		{eslEvent{"Channel-Name": "sofia/gateway/carrier-b"}, "carrier-b"},
+		{eslEvent{"Channel-Name": "sofia/external/1000@198.51.100.7"}, ""},
+		{eslEvent{"Channel-Name": "loopback/9664-a"}, ""},
+	}
+	for _, test := range tests {
+		if got := gatewayName(test.event); got != test.want {
+			t.Errorf("gatewayName(%v) = %q, want %q", test.event, got, test.want)
+		}
+	}
+}
+
+func TestStatusFromHeartbeat(t *testing.T) {
+	server := newFakeServer(t)
+	c := newTestCollector(t, server, "status")
+
+	handler := newHeartbeatHandler(testEventConfig(t)).(*heartbeatHandler)
+	for _, event := range loadEvents(t) {
+		if eventKey(event) == "HEARTBEAT" {
+			handler.handle(event)
+		}
+	}
+	c.heartbeat = handler
+
+	// the first scrape runs the status command for min_idle_cpu
+	compareGolden(t, "status", gather(t, c))
+	compareGolden(t, "status_heartbeat", gather(t, c))
+	if commands := slices.DeleteFunc(server.received(), func(command string) bool { return command != "api status" }); len(commands) != 1 {
+		t.Errorf("status command sent %d times despite a recent heartbeat", len(commands))
+	}
+	if age, ok := gatherValue(t, handler, namespace+"_heartbeat_age_seconds"); !ok || age > 5 {
+		t.Errorf("unexpected heartbeat age %v", age)
+	}
+
+	// a stale heartbeat falls back to the status command
+	handler.received = time.Now().Add(-2 * time.Minute)
+	compareGolden(t, "status", gather(t, c))
+
+	// so does an incomplete one
+	handler.handle(eslEvent{"Event-Name": "HEARTBEAT", "Session-Count": "6"})
+	compareGolden(t, "status", gather(t, c))
+}
+
+// gatherValue returns the value of the gauge called name collected from c.
+func gatherValue(t *testing.T, c prometheus.Collector, name string) (float64, bool) {
+	t.Helper()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == name {
+			return family.GetMetric()[0].GetGauge().GetValue(), true
+		}
+	}
+	return 0, false
+}
+
+func TestRegistrationProto(t *testing.T) {
+	tests := []struct {
+		event eslEvent
+		want  string
+	}{
+		{eslEvent{"contact": `"1000" <sip:1000@203.0.113.20:5060;fs_nat=yes;fs_path=<sip:1000@10.0.0.20:5060>>`}, "udp"},
+		{eslEvent{"contact": "<sip:1001@198.51.100.30:49832;transport=TCP>;expires=600"}, "tcp"},
+		{eslEvent{"contact": "<sips:1002@198.51.100.31:5061>"}, "tls"},
+		{eslEvent{"contact": "<sip:1003@198.51.100.32>", "network-proto": "WSS"}, "wss"},
+		{eslEvent{"to-user": "1004"}, ""},
+	}
+	for _, test := range tests {
+		if got := registrationProto(test.event); got != test.want {
+			t.Errorf("registrationProto(%v) = %q, want %q", test.event, got, test.want)
+		}
+	}
+}
+
+func TestConferenceRooms(t *testing.T) {
+	cfg := testEventConfig(t)
+	cfg.conferenceRooms = true
+	handler := newConferenceHandler(cfg)
+	handler.handle(eslEvent{
+		"Event-Name":              "CUSTOM",
+		"Event-Subclass":          "conference::maintenance",
+		"Conference-Name":         "3000",
+		"Conference-Profile-Name": "default",
+		"Action":                  "add-member",
+	})
+
+	want := `freeswitch_conference_events_total{action="add-member",conference="3000",profile="default"} 1`
+	if got := string(gather(t, handler)); !strings.Contains(got, want) {
+		t.Errorf("expected %s, got:\n%s", want, got)
+	}
+}
+
+func TestConferencePrune(t *testing.T) {
+	handler := newConferenceHandler(testEventConfig(t)).(*conferenceHandler)
+	event := func(action, id string, timestamp int64) eslEvent {
+		return eslEvent{
+			"Event-Name":              "CUSTOM",
+			"Event-Subclass":          "conference::maintenance",
+			"Event-Date-Timestamp":    strconv.FormatInt(timestamp, 10),
+			"Conference-Unique-ID":    id,
+			"Conference-Profile-Name": "default",
+			"Action":                  action,
+		}
+	}
+	start := int64(1700000000000000)
+	handler.handle(event("conference-create", "a", start))
+	handler.handle(event("conference-create", "b", start+stateMaxAge))
+	if len(handler.created) != 2 {
+		t.Fatalf("expected 2 conferences before the max age, got %d", len(handler.created))
+	}
+	// the destruction of a was missed
+	handler.handle(event("conference-create", "c", start+stateMaxAge+statePruneTime))
+	if _, ok := handler.created["a"]; ok || len(handler.created) != 2 {
+		t.Errorf("expected a to be pruned, got %v", handler.created)
+	}
+}
+
+func TestRecordingsByCall(t *testing.T) {
+	cfg := testEventConfig(t)
+	cfg.recordingContexts = []string{"public"}
+	handler := newRecordingsHandler(cfg).(*recordingsHandler)
+	start := int64(1700000000000000)
+	hangup := func(id, direction string, timestamp int64) eslEvent {
+		return eslEvent{
+			"Event-Name":            "CHANNEL_HANGUP_COMPLETE",
+			"Event-Date-Timestamp":  strconv.FormatInt(timestamp, 10),
+			"Unique-ID":             id,
+			"Call-Direction":        direction,
+			"Caller-Context":        "public",
+			"variable_call_uuid":    "a",
+			"variable_answer_epoch": "1700000000",
+		}
+	}
+	// only the b-leg records, and hangs up first
+	handler.handle(eslEvent{
+		"Event-Name":           "RECORD_START",
+		"Event-Date-Timestamp": strconv.FormatInt(start, 10),
+		"Unique-ID":            "b",
+		"Other-Leg-Unique-ID":  "a",
+		"variable_call_uuid":   "a",
+		"Record-File-Path":     "/tmp/b.wav",
+	})
+	handler.handle(hangup("b", "outbound", start+1e6))
+	handler.handle(hangup("a", "inbound", start+2e6))
+	if got := string(gather(t, handler)); strings.Contains(got, "freeswitch_recordings_missing_total{") {
+		t.Errorf("expected the call recorded on its b-leg not to be missing, got:\n%s", got)
+	}
+	if len(handler.recorded) != 0 {
+		t.Errorf("expected the recorded calls to be forgotten, got %v", handler.recorded)
+	}
+
+	// the stop of the recording was missed
+	handler.handle(hangup("c", "outbound", start+stateMaxAge+statePruneTime))
+	if len(handler.recordings) != 0 {
+		t.Errorf("expected the recording to be pruned, got %v", handler.recordings)
+	}
+	want := `freeswitch_recordings_active{profile=""} 0`
+	if got := string(gather(t, handler)); !strings.Contains(got, want) {
+		t.Errorf("expected %s, got:\n%s", want, got)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	fakePassword = "ClueCon"
+	fixturesDir  = "testdata/fixtures"
+)
+
+// fakeResponse is the answer of the fake server to a command. Without any
+// field set, an empty api/response is sent.
+type fakeResponse struct {
+	body       string        // body of the api/response
+	reply      string        // sent as command/reply instead, e.g. "-ERR permission denied"
+	raw        string        // sent as it is instead, e.g. to simulate a malformed frame
+	delay      time.Duration // time to wait before answering
+	disconnect bool          // close the connection, after a disconnect notice unless raw is set
+}
+
+func (r fakeResponse) frames() []byte {
+	switch {
+	case r.raw != "":
+		return []byte(r.raw)
+	case r.disconnect:
+		return encodeFrame(&eslFrame{
+			header: textproto.MIMEHeader{"Content-Type": {"text/disconnect-notice"}},
+			body:   []byte("Disconnected, goodbye.\nSee you at ClueCon! http://www.cluecon.com/\n"),
+		})
+	case r.reply != "":
+		return replyFrame(r.reply)
+	}
+	return apiFrame(r.body)
+}
+
+// fakeServer is a mod_event_socket listening on localhost for tests. api
+// commands are answered with the responses set with handle, falling back to
+// the fixtures in testdata/fixtures (in the format written by
+// --freeswitch.record-dir) and to "Command not found". Events are sent with
+// publish to the connections which subscribed to any.
+type fakeServer struct {
+	t        *testing.T
+	listener net.Listener
+
+	mutex     sync.Mutex
+	responses map[string]fakeResponse
+	commands  []string
+	conns     []*fakeConn
+}
+
+// fakeConn serializes the writes of responses and events.
+type fakeConn struct {
+	net.Conn
+	mutex      sync.Mutex
+	subscribed bool
+}
+
+func (c *fakeConn) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.Conn.Write(p)
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveFake(t, listener)
+}
+
+// newFakeTLSServer returns a fake server behind TLS, with a self-signed
+// certificate for 127.0.0.1 which is the only one in the returned pool.
+func newFakeTLSServer(t *testing.T) (*fakeServer, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "freeswitch"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return serveFake(t, tls.NewListener(listener, config)), pool
+}
+
+// serveFake answers the connections of listener as a fake server.
+func serveFake(t *testing.T, listener net.Listener) *fakeServer {
+	s := &fakeServer{
+		t:         t,
+		listener:  listener,
+		responses: make(map[string]fakeResponse),
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			fc := &fakeConn{Conn: conn}
+			s.mutex.Lock()
+			s.conns = append(s.conns, fc)
+			s.mutex.Unlock()
+
+			go serveESL(fc, func(command string, header textproto.MIMEHeader) ([]byte, bool) {
+				return s.answer(fc, command, header)
+			})
+		}
+	}()
+	return s
+}
+
+// uri returns the scrape URI of the server.
+func (s *fakeServer) uri() string {
+	return "tcp://" + s.listener.Addr().String()
+}
+
+// handle sets the response to command, e.g. "api status".
+func (s *fakeServer) handle(command string, response fakeResponse) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.responses[command] = response
+}
+
+// received returns the commands received so far, bgapi jobs as their api command.
+func (s *fakeServer) received() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// publish sends event to the subscribed connections.
+func (s *fakeServer) publish(event map[string]string) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	frame := encodeFrame(&eslFrame{
+		header: textproto.MIMEHeader{"Content-Type": {"text/event-json"}},
+		body:   body,
+	})
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, conn := range s.conns {
+		if conn.subscribed {
+			conn.Write(frame)
+		}
+	}
+}
+
+// subscribed waits for a connection to subscribe to events.
+func (s *fakeServer) subscribed() {
+	s.t.Helper()
+
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		s.mutex.Lock()
+		for _, conn := range s.conns {
+			if conn.subscribed {
+				s.mutex.Unlock()
+				return
+			}
+		}
+		s.mutex.Unlock()
+	}
+	s.t.Fatal("no connection subscribed to events")
+}
+
+// drop closes all connections.
+func (s *fakeServer) drop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *fakeServer) answer(conn *fakeConn, command string, _ textproto.MIMEHeader) ([]byte, bool) {
+	s.mutex.Lock()
+	s.commands = append(s.commands, command)
+	if strings.HasPrefix(command, "event ") || strings.HasPrefix(command, "myevents") {
+		conn.subscribed = true
+	}
+	response, ok := s.responses[command]
+	s.mutex.Unlock()
+
+	time.Sleep(response.delay)
+
+	name, args, _ := strings.Cut(command, " ")
+	switch {
+	case ok:
+		return response.frames(), !response.disconnect
+	case name == "auth":
+		return s.login(args == fakePassword)
+	case name == "userauth":
+		return s.login(strings.HasSuffix(args, ":"+fakePassword) && strings.Contains(args, "@"))
+	case name == "api":
+		if _, err := os.Stat(filepath.Join(fixturesDir, fixtureName(command))); err == nil {
+			return loadFixture(fixturesDir, command), true
+		}
+		return apiFrame(fmt.Sprintf("-ERR %s Command not found!\n", args)), true
+	}
+	return replyFrame("+OK"), true
+}
+
+// login answers an auth command the way FreeSWITCH does, which hangs up on
+// wrong credentials.
+func (s *fakeServer) login(ok bool) ([]byte, bool) {
+	if ok {
+		return replyFrame("+OK accepted"), true
+	}
+	return append(replyFrame("-ERR invalid"), fakeResponse{disconnect: true}.frames()...), false
+}
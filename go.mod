@@ -4,13 +4,13 @@ go 1.22
 
 require (
 	github.com/alecthomas/kingpin/v2 v2.4.0
+	github.com/jpillora/backoff v1.0.0
 	github.com/prometheus/client_golang v1.19.1
 )
 
 require (
 	github.com/coreos/go-systemd/v22 v22.5.0 // indirect
 	github.com/go-logfmt/logfmt v0.6.0 // indirect
-	github.com/jpillora/backoff v1.0.0 // indirect
 	github.com/mwitkow/go-conntrack v0.0.0-20190716064945-2f068394615f // indirect
 	github.com/xhit/go-str2duration/v2 v2.1.0 // indirect
 	golang.org/x/crypto v0.24.0 // indirect
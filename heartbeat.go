@@ -0,0 +1,107 @@
+package main
+
+import (
+	"maps"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var heartbeatAgeDesc = prometheus.NewDesc(
+	namespace+"_heartbeat_age_seconds",
+	"Time since the last HEARTBEAT event was received.",
+	nil, nil,
+)
+
+// heartbeatHandler keeps the last HEARTBEAT event, which FreeSWITCH sends
+// every 20 seconds with the same core stats as the status command. While it
+// is recent, the status collector takes the stats from it rather than parsing
+// the text of the command.
+type heartbeatHandler struct {
+	maxAge time.Duration
+
+	mutex    sync.Mutex
+	event    eslEvent
+	received time.Time
+}
+
+func newHeartbeatHandler(cfg *eventConfig) eventHandler {
+	return &heartbeatHandler{maxAge: cfg.heartbeatMaxAge}
+}
+
+func (h *heartbeatHandler) subscriptions() []string {
+	return []string{"HEARTBEAT"}
+}
+
+func (h *heartbeatHandler) handle(event eslEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.event = event
+	h.received = time.Now()
+}
+
+// latest returns the last HEARTBEAT event, or nil if none was received
+// within the maximum age.
+func (h *heartbeatHandler) latest() eslEvent {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.event == nil || time.Since(h.received) > h.maxAge {
+		return nil
+	}
+	return h.event
+}
+
+func (h *heartbeatHandler) Describe(ch chan<- *prometheus.Desc) {
+	ch <- heartbeatAgeDesc
+}
+
+func (h *heartbeatHandler) Collect(ch chan<- prometheus.Metric) {
+	h.mutex.Lock()
+	received := h.received
+	h.mutex.Unlock()
+
+	// a core which never sent any heartbeat has no age yet
+	if received.IsZero() {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(heartbeatAgeDesc, prometheus.GaugeValue, time.Since(received).Seconds())
+}
+
+// heartbeatMetrics sends the status metrics of metricList held by event,
+// with statusOnly for those it does not hold, and reports whether all of
+// them were found.
+func heartbeatMetrics(event eslEvent, statusOnly map[string]float64, ch chan<- prometheus.Metric) (bool, error) {
+	values := maps.Clone(statusOnly)
+	if values == nil {
+		values = make(map[string]float64)
+	}
+	for _, metricDef := range metricList {
+		if len(metricDef.Header) == 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(event[metricDef.Header], 64)
+		if err != nil {
+			return false, nil
+		}
+		values[metricDef.Name] = value
+	}
+
+	for _, metricDef := range metricList {
+		value, ok := values[metricDef.Name]
+		if !ok {
+			continue
+		}
+		metric, err := prometheus.NewConstMetric(
+			prometheus.NewDesc(namespace+"_"+metricDef.Name, metricDef.Help, nil, nil),
+			metricDef.Type,
+			value,
+		)
+		if err != nil {
+			return false, err
+		}
+		ch <- metric
+	}
+	return true, nil
+}
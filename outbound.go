@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// mosBuckets cover the MOS scale, from bad (1) to excellent (4.5).
+var mosBuckets = []float64{1, 2, 2.5, 3, 3.5, 4, 4.5}
+
+// outboundServer is the target of the socket application of the dialplan,
+// e.g. &socket(exporter:8084 async full), for calls to be sampled. A call is
+// handed back to the dialplan right away, after an inbound connection of its
+// own subscribed to the events of its channel, which are followed until the
+// hangup to keep aggregated media and signalling stats.
+//
+// The sample label is the exporter_sample variable of the channel, which
+// the dialplan sets to a few fixed values to keep the number of series
+// bounded; calls without it are not followed.
+type outboundServer struct {
+	// newConn returns a connection to follow a call with, set up like the
+	// one to scrape
+	newConn  func() *Collector
+	maxCalls int
+	logger   log.Logger
+
+	mutex sync.Mutex
+	calls int
+
+	active     prometheus.Gauge
+	skipped    *prometheus.CounterVec
+	hangups    *prometheus.CounterVec
+	answerTime *prometheus.HistogramVec
+	mos        *prometheus.HistogramVec
+	packets    *prometheus.CounterVec
+	lost       *prometheus.CounterVec
+}
+
+func newOutboundServer(newConn func() *Collector, cfg *eventConfig, maxCalls int, logger log.Logger) *outboundServer {
+	return &outboundServer{
+		newConn:  newConn,
+		maxCalls: maxCalls,
+		logger:   logger,
+		active: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "sampled_calls_active",
+			Help:      "Number of sampled calls being followed.",
+		}),
+		skipped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sampled_calls_skipped_total",
+			Help:      "Number of calls handed back to the dialplan without being followed, by reason.",
+		}, []string{"reason"}),
+		hangups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sampled_calls_total",
+			Help:      "Number of sampled calls hung up, by hangup cause.",
+		}, []string{"sample", "cause"}),
+		answerTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "sampled_call_answer_time_seconds",
+			Help:      "Time from the creation of the answered sampled calls to their answer.",
+			Buckets:   cfg.setupBuckets,
+		}, []string{"sample"}),
+		mos: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "sampled_call_mos",
+			Help:      "Estimated mean opinion score of the audio received on the sampled calls.",
+			Buckets:   mosBuckets,
+		}, []string{"sample"}),
+		packets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sampled_rtp_packets_total",
+			Help:      "Number of audio RTP packets of the sampled calls, by direction.",
+		}, []string{"sample", "direction"}),
+		lost: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sampled_rtp_lost_packets_total",
+			Help:      "Number of audio RTP packets of the sampled calls which never arrived.",
+		}, []string{"sample"}),
+	}
+}
+
+// serve accepts the connections of the socket application until listener is
+// closed.
+func (s *outboundServer) serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle samples the call of conn and hands it back to the dialplan.
+func (s *outboundServer) handle(conn net.Conn) {
+	client := newESLClient(conn)
+	defer client.Close()
+
+	follow := s.newConn()
+	ctx, cancel := context.WithTimeout(context.Background(), follow.Timeout)
+	defer cancel()
+
+	channel, err := client.connect(ctx)
+	if err != nil {
+		level.Warn(s.logger).Log("msg", "cannot start outbound session", "remote", conn.RemoteAddr(), "err", err)
+		return
+	}
+	id := channel.Get("Unique-ID")
+	sample := channel.Get("variable_exporter_sample")
+	logger := log.With(s.logger, "uuid", id, "sample", sample)
+
+	// the subscription is made while the call waits in the socket
+	// application, so that none of its events are missed
+	followed := false
+	switch {
+	case sample == "":
+		s.skipped.WithLabelValues("no_sample").Inc()
+	case !s.acquire():
+		s.skipped.WithLabelValues("limit").Inc()
+	default:
+		defer s.release()
+		if err = s.subscribe(ctx, follow, id); err != nil {
+			level.Warn(logger).Log("msg", "cannot follow call", "err", err)
+			s.skipped.WithLabelValues("error").Inc()
+		} else {
+			defer follow.closeClient()
+			followed = true
+		}
+	}
+
+	// resume lets the dialplan go on once the socket is closed
+	for _, command := range []string{"resume", "exit"} {
+		if _, err = client.command(ctx, command); err != nil {
+			level.Warn(logger).Log("msg", "cannot hand call back to the dialplan", "err", err)
+			break
+		}
+	}
+	client.Close()
+	cancel()
+
+	if followed {
+		if err = s.follow(follow.client, sample); err != nil {
+			level.Warn(logger).Log("msg", "call lost before its hangup", "err", err)
+		}
+	}
+}
+
+// acquire reports whether one more call may be followed.
+func (s *outboundServer) acquire() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.calls >= s.maxCalls {
+		return false
+	}
+	s.calls++
+	s.active.Set(float64(s.calls))
+	return true
+}
+
+func (s *outboundServer) release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls--
+	s.active.Set(float64(s.calls))
+}
+
+// subscribe connects follow and subscribes it to the events of the channel.
+func (s *outboundServer) subscribe(ctx context.Context, follow *Collector, id string) error {
+	if id == "" {
+		return errors.New("no Unique-ID in the channel data")
+	}
+	if err := follow.dial(ctx); err != nil {
+		return err
+	}
+	if _, err := follow.client.command(ctx, "myevents "+id+" json"); err != nil {
+		follow.closeClient()
+		return err
+	}
+	return nil
+}
+
+// follow reads the events of a channel until its hangup, and keeps its stats.
+func (s *outboundServer) follow(client *eslClient, sample string) error {
+	// the call may last for hours, a dead connection is found by the TCP
+	// keepalive
+	client.conn.SetDeadline(time.Time{})
+
+	for {
+		frame, err := client.readFrame()
+		if err != nil {
+			return err
+		}
+
+		switch frame.contentType() {
+		case "text/event-json":
+			event, err := parseEvent(frame.body)
+			if err != nil {
+				return err
+			}
+			if event["Event-Name"] == "CHANNEL_HANGUP_COMPLETE" {
+				s.observe(event, sample)
+				return nil
+			}
+		case "text/disconnect-notice":
+			return fmt.Errorf("%w: %s", ErrDisconnected, strings.TrimSpace(string(frame.body)))
+		}
+	}
+}
+
+// observe keeps the stats of the hangup event of a sampled call.
+func (s *outboundServer) observe(event eslEvent, sample string) {
+	s.hangups.WithLabelValues(sample, event["Hangup-Cause"]).Inc()
+	if answer, ok := seconds(event, "variable_answermsec", 1000); ok && answer > 0 && answered(event) {
+		s.answerTime.WithLabelValues(sample).Observe(answer)
+	}
+	// calls without media have no stats
+	if mos, ok := seconds(event, "variable_rtp_audio_in_mos", 1); ok && mos > 0 {
+		s.mos.WithLabelValues(sample).Observe(mos)
+	}
+	for _, direction := range []string{"in", "out"} {
+		if packets, ok := seconds(event, "variable_rtp_audio_"+direction+"_media_packet_count", 1); ok {
+			s.packets.WithLabelValues(sample, direction).Add(packets)
+		}
+	}
+	if lost, ok := seconds(event, "variable_rtp_audio_in_skip_packet_count", 1); ok {
+		s.lost.WithLabelValues(sample).Add(lost)
+	}
+}
+
+func (s *outboundServer) Describe(ch chan<- *prometheus.Desc) {
+	s.active.Describe(ch)
+	s.skipped.Describe(ch)
+	s.hangups.Describe(ch)
+	s.answerTime.Describe(ch)
+	s.mos.Describe(ch)
+	s.packets.Describe(ch)
+	s.lost.Describe(ch)
+}
+
+func (s *outboundServer) Collect(ch chan<- prometheus.Metric) {
+	s.active.Collect(ch)
+	s.skipped.Collect(ch)
+	s.hangups.Collect(ch)
+	s.answerTime.Collect(ch)
+	s.mos.Collect(ch)
+	s.packets.Collect(ch)
+	s.lost.Collect(ch)
+}
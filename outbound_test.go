@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+// startOutboundServer returns an outbound server following calls through
+// server, listening on a local address.
+func startOutboundServer(t *testing.T, server *fakeServer, maxCalls int) (*outboundServer, string) {
+	t.Helper()
+
+	newConn := func() *Collector {
+		conn, err := NewCollector(server.uri(), 5*time.Second, fakePassword, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	s := newOutboundServer(newConn, testEventConfig(t), maxCalls, log.NewNopLogger())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go s.serve(listener)
+	return s, listener.Addr().String()
+}
+
+// dialOutbound plays the socket application of a channel connecting to the
+// outbound server at address, and returns the commands it received until the
+// call was handed back.
+func dialOutbound(t *testing.T, address string, channel map[string]string) []string {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// the values of the channel data are URL encoded
+	header := textproto.MIMEHeader{"Content-Type": {"command/reply"}, "Reply-Text": {"+OK"}}
+	for key, value := range channel {
+		header.Set(key, url.PathEscape(value))
+	}
+
+	var commands []string
+	input := textproto.NewReader(bufio.NewReader(conn))
+	for {
+		command, _, err := readCommand(input)
+		if err != nil {
+			t.Fatalf("after %q: %v", commands, err)
+		}
+		commands = append(commands, command)
+
+		switch command {
+		case "connect":
+			_, err = conn.Write(encodeFrame(&eslFrame{header: header}))
+		case "exit":
+			conn.Write(replyFrame("+OK bye"))
+			return commands
+		default:
+			_, err = conn.Write(replyFrame("+OK"))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOutboundServer(t *testing.T) {
+	server := newFakeServer(t)
+	s, address := startOutboundServer(t, server, 10)
+
+	const id = "00000000-0000-4000-8000-000000000010"
+	commands := dialOutbound(t, address, map[string]string{
+		"Unique-ID":                 id,
+		"Channel-Name":              "sofia/external/+15557654321@198.51.100.7",
+		"Caller-Destination-Number": "+15551239000",
+		"variable_exporter_sample":  "support line",
+	})
+	if want := []string{"connect", "resume", "exit"}; !slices.Equal(commands, want) {
+		t.Errorf("expected %q, got %q", want, commands)
+	}
+	// the call was followed before it was handed back
+	if want := "myevents " + id + " json"; !slices.Contains(server.received(), want) {
+		t.Errorf("expected %q, got %q", want, server.received())
+	}
+
+	server.publish(map[string]string{"Event-Name": "CHANNEL_ANSWER", "Unique-ID": id})
+	server.publish(map[string]string{
+		"Event-Name":                "CHANNEL_HANGUP_COMPLETE",
+		"Unique-ID":                 id,
+		"Hangup-Cause":              "NORMAL_CLEARING",
+		"variable_answer_epoch":     "1697040300",
+		"variable_answermsec":       "1200",
+		"variable_rtp_audio_in_mos": "4.32",
+		"variable_rtp_audio_in_media_packet_count":  "3000",
+		"variable_rtp_audio_out_media_packet_count": "3010",
+		"variable_rtp_audio_in_skip_packet_count":   "12",
+	})
+
+	// the call is no longer followed once it hung up
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if value, _ := gatherValue(t, s.active, namespace+"_sampled_calls_active"); value == 0 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("call still followed after its hangup")
+		}
+	}
+	compareGolden(t, "outbound", gather(t, s))
+}
+
+func TestOutboundServerLimit(t *testing.T) {
+	server := newFakeServer(t)
+	s, address := startOutboundServer(t, server, 0)
+
+	commands := dialOutbound(t, address, map[string]string{
+		"Unique-ID":                "00000000-0000-4000-8000-000000000011",
+		"variable_exporter_sample": "support line",
+	})
+	if want := []string{"connect", "resume", "exit"}; !slices.Equal(commands, want) {
+		t.Errorf("expected %q, got %q", want, commands)
+	}
+	if slices.ContainsFunc(server.received(), func(command string) bool { return command != "auth "+fakePassword }) {
+		t.Errorf("call followed beyond the limit: %q", server.received())
+	}
+	want := namespace + `_sampled_calls_skipped_total{reason="limit"} 1`
+	if got := string(gather(t, s)); !strings.Contains(got, want) {
+		t.Errorf("expected %s, got:\n%s", want, got)
+	}
+}
+
+func TestOutboundServerNoSample(t *testing.T) {
+	server := newFakeServer(t)
+	s, address := startOutboundServer(t, server, 10)
+
+	// the destination number is not a sample, it has no bound
+	commands := dialOutbound(t, address, map[string]string{
+		"Unique-ID":                 "00000000-0000-4000-8000-000000000012",
+		"Caller-Destination-Number": "+15551239000",
+	})
+	if want := []string{"connect", "resume", "exit"}; !slices.Equal(commands, want) {
+		t.Errorf("expected %q, got %q", want, commands)
+	}
+	if slices.ContainsFunc(server.received(), func(command string) bool { return command != "auth "+fakePassword }) {
+		t.Errorf("call followed without a sample: %q", server.received())
+	}
+	want := namespace + `_sampled_calls_skipped_total{reason="no_sample"} 1`
+	if got := string(gather(t, s)); !strings.Contains(got, want) {
+		t.Errorf("expected %s, got:\n%s", want, got)
+	}
+}
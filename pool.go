@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// eslPool keeps authenticated connections of /probe targets for reuse. It
+// holds at most size idle connections, none if size is not positive, closing
+// the least recently used one when full, and closes connections idle for longer than idleTimeout unless
+// it is not positive.
+type eslPool struct {
+	size        int
+	idleTimeout time.Duration
+
+	mutex sync.Mutex
+	idle  map[string][]*pooledClient // most recently used last
+	count int
+}
+
+type pooledClient struct {
+	client   *eslClient
+	lastUsed time.Time
+}
+
+func newESLPool(size int, idleTimeout time.Duration) *eslPool {
+	p := &eslPool{
+		size:        size,
+		idleTimeout: idleTimeout,
+		idle:        make(map[string][]*pooledClient),
+	}
+	if idleTimeout > 0 {
+		go p.run()
+	}
+	return p
+}
+
+// poolKey identifies the connections of a target that may be shared.
+func poolKey(target, user, password string) string {
+	return fmt.Sprintf("%s#%s#%x", target, user, sha256.Sum256([]byte(password)))
+}
+
+// run closes idle connections which expired, so that targets which are no
+// longer probed do not hold connections forever.
+func (p *eslPool) run() {
+	// connections are expired by get and put as well, the ticker only has to
+	// catch the targets which are no longer probed
+	ticker := time.NewTicker(max(p.idleTimeout/2, time.Second))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		p.mutex.Lock()
+		p.expire(time.Now())
+		p.mutex.Unlock()
+	}
+}
+
+// get returns a healthy idle connection for key, or nil when there is none.
+func (p *eslPool) get(key string) *eslClient {
+	for {
+		client := p.pop(key)
+		if client == nil {
+			poolMisses.Inc()
+			return nil
+		}
+		if client.alive() {
+			poolHits.Inc()
+			return client
+		}
+		client.Close()
+		poolEvictions.WithLabelValues("unhealthy").Inc()
+	}
+}
+
+// pop takes the most recently used idle connection of key out of the pool.
+func (p *eslPool) pop(key string) *eslClient {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.expire(time.Now())
+
+	clients := p.idle[key]
+	if len(clients) == 0 {
+		return nil
+	}
+	last := clients[len(clients)-1]
+	p.remove(key, len(clients)-1)
+	return last.client
+}
+
+// put hands back client after a successful scrape.
+func (p *eslPool) put(key string, client *eslClient) {
+	if p.size <= 0 {
+		client.Close()
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	p.expire(now)
+
+	if p.count >= p.size {
+		p.evictOldest()
+	}
+
+	p.idle[key] = append(p.idle[key], &pooledClient{client: client, lastUsed: now})
+	p.count++
+	poolConnections.Set(float64(p.count))
+}
+
+// expire closes connections idle since before now - idleTimeout.
+func (p *eslPool) expire(now time.Time) {
+	if p.idleTimeout <= 0 {
+		return
+	}
+	for key, clients := range p.idle {
+		for i := len(clients) - 1; i >= 0; i-- {
+			if now.Sub(clients[i].lastUsed) > p.idleTimeout {
+				clients[i].client.Close()
+				p.remove(key, i)
+				poolEvictions.WithLabelValues("idle").Inc()
+			}
+		}
+	}
+}
+
+func (p *eslPool) evictOldest() {
+	var oldestKey string
+	oldest := -1
+	for key, clients := range p.idle {
+		// clients are ordered by lastUsed, the first one is the oldest of key
+		if oldest < 0 || clients[0].lastUsed.Before(p.idle[oldestKey][oldest].lastUsed) {
+			oldestKey, oldest = key, 0
+		}
+	}
+	if oldest < 0 {
+		return
+	}
+
+	p.idle[oldestKey][oldest].client.Close()
+	p.remove(oldestKey, oldest)
+	poolEvictions.WithLabelValues("capacity").Inc()
+}
+
+// remove drops the i-th idle connection of key from the pool without closing it.
+func (p *eslPool) remove(key string, i int) {
+	clients := append(p.idle[key][:i], p.idle[key][i+1:]...)
+	if len(clients) == 0 {
+		delete(p.idle, key)
+	} else {
+		p.idle[key] = clients
+	}
+	p.count--
+	poolConnections.Set(float64(p.count))
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pipeClient returns a client whose connection is one end of a pipe, and the
+// other end, which reads io.EOF once the client is closed.
+func pipeClient(t *testing.T) (*eslClient, net.Conn) {
+	t.Helper()
+
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	return newESLClient(local), remote
+}
+
+// closed reports whether the client at the other end of remote was closed.
+func closed(remote net.Conn) bool {
+	remote.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := remote.Read(make([]byte, 1))
+	return err == io.EOF
+}
+
+// pooled returns the number of idle connections of p.
+func pooled(p *eslPool) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.count
+}
+
+func TestPoolReuse(t *testing.T) {
+	p := newESLPool(2, time.Minute)
+	key := poolKey("tcp://127.0.0.1:8021", "", fakePassword)
+
+	if client := p.get(key); client != nil {
+		t.Fatal("empty pool returned a connection")
+	}
+
+	client, _ := pipeClient(t)
+	p.put(key, client)
+	if got := p.get(key); got != client {
+		t.Fatalf("expected the pooled connection, got %v", got)
+	}
+	if got := p.get(key); got != nil {
+		t.Fatal("connection handed out twice")
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	p := newESLPool(2, time.Minute)
+	key := poolKey("tcp://127.0.0.1:8021", "", fakePassword)
+
+	client, remote := pipeClient(t)
+	p.put(key, client)
+	// freeswitch hung up while the connection was idle
+	remote.Close()
+
+	if got := p.get(key); got != nil {
+		t.Fatal("dead connection reused")
+	}
+	if n := pooled(p); n != 0 {
+		t.Errorf("dead connection kept in the pool: %d connections", n)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	p := newESLPool(2, time.Nanosecond)
+	key := poolKey("tcp://127.0.0.1:8021", "", fakePassword)
+
+	client, remote := pipeClient(t)
+	p.put(key, client)
+	time.Sleep(time.Millisecond)
+
+	if got := p.get(key); got != nil {
+		t.Fatal("expired connection reused")
+	}
+	if !closed(remote) {
+		t.Error("expired connection not closed")
+	}
+}
+
+func TestPoolWithoutIdleTimeout(t *testing.T) {
+	p := newESLPool(2, 0)
+	key := poolKey("tcp://127.0.0.1:8021", "", fakePassword)
+
+	client, _ := pipeClient(t)
+	p.put(key, client)
+	time.Sleep(time.Millisecond)
+
+	if got := p.get(key); got != client {
+		t.Fatalf("expected the pooled connection, got %v", got)
+	}
+}
+
+func TestPoolSize(t *testing.T) {
+	p := newESLPool(2, time.Minute)
+
+	var remotes []net.Conn
+	for _, target := range []string{"tcp://192.0.2.1:8021", "tcp://192.0.2.2:8021", "tcp://192.0.2.3:8021"} {
+		client, remote := pipeClient(t)
+		p.put(poolKey(target, "", fakePassword), client)
+		remotes = append(remotes, remote)
+		time.Sleep(time.Millisecond)
+	}
+
+	if n := pooled(p); n != 2 {
+		t.Errorf("expected 2 connections, got %d", n)
+	}
+	// the least recently used one made room
+	if !closed(remotes[0]) {
+		t.Error("oldest connection not closed")
+	}
+	if p.get(poolKey("tcp://192.0.2.1:8021", "", fakePassword)) != nil {
+		t.Error("oldest connection still pooled")
+	}
+	if p.get(poolKey("tcp://192.0.2.3:8021", "", fakePassword)) == nil {
+		t.Error("newest connection not pooled")
+	}
+}
+
+func TestPoolSizeZero(t *testing.T) {
+	p := newESLPool(0, time.Minute)
+	key := poolKey("tcp://127.0.0.1:8021", "", fakePassword)
+
+	client, remote := pipeClient(t)
+	p.put(key, client)
+	if !closed(remote) {
+		t.Error("connection not closed by a pool without room")
+	}
+	if n := pooled(p); n != 0 {
+		t.Errorf("expected no connection, got %d", n)
+	}
+}
+
+func TestPoolKey(t *testing.T) {
+	p := newESLPool(2, time.Minute)
+	target := "tcp://127.0.0.1:8021"
+
+	client, _ := pipeClient(t)
+	p.put(poolKey(target, "", fakePassword), client)
+
+	// connections are only shared with probes holding the same credentials
+	for _, key := range []string{
+		poolKey(target, "", "secret"),
+		poolKey(target, "monitor@example.com", fakePassword),
+		poolKey("tcp://127.0.0.1:8022", "", fakePassword),
+	} {
+		if p.get(key) != nil {
+			t.Errorf("connection shared with %s", key)
+		}
+	}
+	if key := poolKey(target, "", fakePassword); strings.Contains(key, fakePassword) {
+		t.Errorf("password in pool key %s", key)
+	}
+	if p.get(poolKey(target, "", fakePassword)) != client {
+		t.Error("connection not reused with the same credentials")
+	}
+}
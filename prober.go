@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"net"
 	"net/http"
@@ -14,7 +15,21 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func probeHandler(w http.ResponseWriter, r *http.Request, logger log.Logger, timeout time.Duration, params url.Values) {
+// probeConfig holds the settings shared by all probes.
+type probeConfig struct {
+	timeout           time.Duration
+	keepAlive         time.Duration
+	tlsConfig         *tls.Config
+	collectorTimeouts map[string]time.Duration
+	bgapi             bool
+	recordDir         string
+	maxResponseSize   int64
+	channelLabels     []string
+	ptimeCalls        int
+	pool              *eslPool
+}
+
+func probeHandler(w http.ResponseWriter, r *http.Request, logger log.Logger, cfg *probeConfig, params url.Values) {
 	if params == nil {
 		params = r.URL.Query()
 	}
@@ -24,7 +39,7 @@ func probeHandler(w http.ResponseWriter, r *http.Request, logger log.Logger, tim
 		return
 	}
 
-	timeoutSeconds, err := getTimeout(r, float64(timeout))
+	timeoutSeconds, err := getTimeout(r, cfg.timeout.Seconds())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -32,12 +47,27 @@ func probeHandler(w http.ResponseWriter, r *http.Request, logger log.Logger, tim
 	password := params.Get("password")
 	disables := params.Get("disables")
 
-	scrapeLogger := log.With(logger, "target", target)
+	scrapeLogger := log.With(logger, "target", redactTarget(target))
 	col, err := NewCollector(target, time.Duration(float64(time.Second)*(timeoutSeconds)), password, scrapeLogger, strings.Split(disables, ",")...)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if col.Username == "" {
+		col.Username = params.Get("username")
+	}
+	col.KeepAlive = cfg.keepAlive
+	col.TLSConfig = cfg.tlsConfig
+	col.CollectorTimeouts = cfg.collectorTimeouts
+	col.BackgroundJobs = cfg.bgapi
+	col.RecordDir = cfg.recordDir
+	col.MaxResponseSize = cfg.maxResponseSize
+	col.ChannelLabels = cfg.channelLabels
+	col.PtimeCalls = cfg.ptimeCalls
+	// stop scraping once prometheus gave up on the request
+	col.ctx = r.Context()
+	col.pool = cfg.pool
+
 	registry := prometheus.NewRegistry()
 	registry.MustRegister(col)
 
@@ -47,6 +77,11 @@ func probeHandler(w http.ResponseWriter, r *http.Request, logger log.Logger, tim
 
 func getTarget(q url.Values) (string, error) {
 	if v := q.Get("target"); v != "" {
+		// replay serves files from the local disk, which is not for any
+		// client of /probe to choose
+		if u, err := url.Parse(v); err == nil && u.Scheme == "replay" {
+			return "", errors.New("replay targets are only supported with --freeswitch.scrape-uri")
+		}
 		return v, nil
 	}
 	if host, port := q.Get("host"), q.Get("port"); host != "" && port != "" {
@@ -55,6 +90,15 @@ func getTarget(q url.Values) (string, error) {
 	return "", errors.New("target or host/port parameter are missing")
 }
 
+// redactTarget hides the password of a target URI for logging.
+func redactTarget(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+	return u.Redacted()
+}
+
 func getTimeout(r *http.Request, timeout float64) (timeoutSeconds float64, err error) {
 	// If a timeout is configured via the Prometheus header, add it to the request.
 	if v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
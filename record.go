@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/go-kit/log/level"
+)
+
+const redacted = "REDACTED"
+
+var (
+	fixtureNameRegex = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+	xmlPasswordRegex = regexp.MustCompile(`(?i)(<password>)[^<]*(</password>)`)
+	// "password":"...", as well as "sip_auth_password": "..." and alike
+	jsonPasswordRegex = regexp.MustCompile(`(?i)("[a-z_-]*password"\s*:\s*")(?:[^"\\]|\\.)*(")`)
+)
+
+// fixtureName returns the file a response to command is recorded in.
+func fixtureName(command string) string {
+	return strings.Trim(fixtureNameRegex.ReplaceAllString(command, "_"), "_") + ".esl"
+}
+
+// recordDir returns the directory the commands of the scrape target are
+// recorded in, each target having its own.
+func (c *Collector) recordDir() string {
+	target := c.url.Scheme + "_" + c.url.Host + c.url.Path
+	return filepath.Join(c.RecordDir, strings.Trim(fixtureNameRegex.ReplaceAllString(target, "_"), "_"))
+}
+
+// record writes the frame answering command to a fixture file, with
+// passwords redacted. It is meant to be installed as eslClient.record, which
+// the login does not go through.
+func (c *Collector) record(command string, frame *eslFrame) {
+	// commands about a single channel, e.g. uuid_getvar, would leave a file
+	// per call behind
+	if strings.HasPrefix(command, "api uuid_") {
+		return
+	}
+	dir := c.recordDir()
+	err := os.MkdirAll(dir, 0o755)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, fixtureName(command)), encodeFrame(redactFrame(frame)), 0o644)
+	}
+	if err != nil {
+		level.Warn(c.logger).Log("msg", "cannot record response", "command", command, "err", err)
+	}
+}
+
+// redactFrame returns a copy of frame without the passwords found in XML
+// and JSON documents.
+func redactFrame(frame *eslFrame) *eslFrame {
+	body := xmlPasswordRegex.ReplaceAll(frame.body, []byte("${1}"+redacted+"${2}"))
+	body = jsonPasswordRegex.ReplaceAll(body, []byte("${1}"+redacted+"${2}"))
+	return &eslFrame{header: frame.header, body: body}
+}
+
+// encodeFrame serializes frame the way FreeSWITCH sends it.
+func encodeFrame(frame *eslFrame) []byte {
+	var buf bytes.Buffer
+
+	keys := make([]string, 0, len(frame.header))
+	for key := range frame.header {
+		if key != "Content-Length" {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	if len(frame.body) > 0 {
+		fmt.Fprintf(&buf, "Content-Length: %d\n", len(frame.body))
+	}
+	for _, key := range keys {
+		for _, value := range frame.header[key] {
+			fmt.Fprintf(&buf, "%s: %s\n", key, value)
+		}
+	}
+	buf.WriteString("\n")
+	buf.Write(frame.body)
+	return buf.Bytes()
+}
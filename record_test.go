@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+func TestRecordReplay(t *testing.T) {
+	server := newFakeServer(t)
+	syncedClock(server)
+
+	c := newTestCollector(t, server, namesOfCollectors()...)
+	c.RecordDir = t.TempDir()
+	recorded := gather(t, c)
+
+	replay := newTestCollector(t, server, namesOfCollectors()...)
+	replay.url.Scheme = "replay"
+	replay.url.Host = ""
+	replay.url.Path = c.recordDir()
+	replayed := gather(t, replay)
+
+	if !bytes.Equal(recorded, replayed) {
+		t.Errorf("replayed metrics differ\nreplayed:\n%s\nrecorded:\n%s", replayed, recorded)
+	}
+
+	raw, err := os.ReadFile(filepath.Join(c.recordDir(), fixtureName("api status")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture, err := os.ReadFile(filepath.Join(fixturesDir, fixtureName("api status")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, fixture) {
+		t.Errorf("recorded frame differs from the one sent\ngot:\n%s\nwant:\n%s", raw, fixture)
+	}
+}
+
+func TestRedactFrame(t *testing.T) {
+	frame := &eslFrame{
+		header: textproto.MIMEHeader{"Content-Type": {"api/response"}},
+		body: []byte(`<gateway><password>s3cret</password></gateway>
+{"sip_auth_password":"p\"w","name":"ClueCon"}`),
+	}
+
+	// the event socket password is not searched for in responses
+	got := string(redactFrame(frame).body)
+	want := `<gateway><password>REDACTED</password></gateway>
+{"sip_auth_password":"REDACTED","name":"ClueCon"}`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestRecordWithoutPassword(t *testing.T) {
+	server := newFakeServer(t)
+	c := newTestCollector(t, server, namesOfCollectors()...)
+	c.RecordDir = t.TempDir()
+	gather(t, c)
+
+	entries, err := os.ReadDir(c.recordDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Fatal("nothing recorded")
+	}
+	for _, entry := range entries {
+		raw, err := os.ReadFile(filepath.Join(c.recordDir(), entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(entry.Name(), fakePassword) || bytes.Contains(raw, []byte(fakePassword)) {
+			t.Errorf("password recorded in %s", entry.Name())
+		}
+	}
+}
+
+func TestProbeReplay(t *testing.T) {
+	dir := t.TempDir()
+	for _, target := range []string{"replay://" + dir, "REPLAY://" + dir} {
+		r := httptest.NewRequest(http.MethodGet, "/probe?target="+url.QueryEscape(target), nil)
+		w := httptest.NewRecorder()
+		probeHandler(w, r, log.NewNopLogger(), &probeConfig{timeout: time.Second}, nil)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", target, http.StatusBadRequest, w.Code)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// recordingsHandler follows the recordings of the channels, and counts the
+// answered calls of the contexts which require a recording but had none on
+// any of their legs.
+type recordingsHandler struct {
+	contexts []string
+
+	active   *prometheus.GaugeVec
+	started  *prometheus.CounterVec
+	stopped  *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	missing  *prometheus.CounterVec
+
+	// recordings are the running recordings by channel and file, recorded
+	// the time the calls and channels which started any were last recorded,
+	// in microseconds, and pruned the time they were last pruned; all are
+	// only used by handle
+	recordings map[string]recording
+	recorded   map[string]int64
+	pruned     int64
+}
+
+// recording is a recording running on a channel.
+type recording struct {
+	profile string
+	// started is the start time of the recording, in microseconds
+	started int64
+}
+
+func newRecordingsHandler(cfg *eventConfig) eventHandler {
+	return &recordingsHandler{
+		contexts: cfg.recordingContexts,
+		active: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "recordings_active",
+			Help:      "Number of recordings running.",
+		}, []string{"profile"}),
+		started: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "recordings_started_total",
+			Help:      "Number of recordings started.",
+		}, []string{"profile"}),
+		stopped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "recordings_stopped_total",
+			Help:      "Number of recordings stopped.",
+		}, []string{"profile"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "recording_duration_seconds",
+			Help:      "Duration of the recordings stopped.",
+			Buckets:   cfg.durationBuckets,
+		}, []string{"profile"}),
+		missing: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "recordings_missing_total",
+			Help:      "Number of answered inbound calls of a context requiring a recording which were never recorded.",
+		}, []string{"context"}),
+		recordings: make(map[string]recording),
+		recorded:   make(map[string]int64),
+	}
+}
+
+func (h *recordingsHandler) subscriptions() []string {
+	events := []string{"RECORD_START", "RECORD_STOP"}
+	if len(h.contexts) > 0 {
+		events = append(events, "CHANNEL_HANGUP_COMPLETE")
+	}
+	return events
+}
+
+func (h *recordingsHandler) handle(event eslEvent) {
+	id := event["Unique-ID"]
+	profile := event["variable_sofia_profile_name"]
+	key := id + " " + event["Record-File-Path"]
+	timestamp, _ := strconv.ParseInt(event["Event-Date-Timestamp"], 10, 64)
+	h.prune(timestamp)
+
+	switch event["Event-Name"] {
+	case "RECORD_START":
+		h.started.WithLabelValues(profile).Inc()
+		if _, ok := h.recordings[key]; !ok {
+			h.active.WithLabelValues(profile).Inc()
+		}
+		h.recordings[key] = recording{profile: profile, started: timestamp}
+		if len(h.contexts) > 0 {
+			// a recording of the b-leg records the call of the a-leg too
+			for _, id := range []string{id, event["variable_call_uuid"], event["Other-Leg-Unique-ID"]} {
+				if id != "" {
+					h.recorded[id] = timestamp
+				}
+			}
+		}
+	case "RECORD_STOP":
+		h.stopped.WithLabelValues(profile).Inc()
+		// recordings started before the subscription are not known
+		running, known := h.recordings[key]
+		if known {
+			delete(h.recordings, key)
+			h.active.WithLabelValues(running.profile).Dec()
+		}
+		// the length of the file, or else the time since the start
+		if duration, ok := seconds(event, "variable_record_ms", 1000); ok {
+			h.duration.WithLabelValues(profile).Observe(duration)
+		} else if known && running.started > 0 && timestamp > 0 {
+			h.duration.WithLabelValues(profile).Observe(float64(timestamp-running.started) / 1e6)
+		}
+	case "CHANNEL_HANGUP_COMPLETE":
+		_, recorded := h.recorded[id]
+		if !recorded {
+			_, recorded = h.recorded[event["variable_call_uuid"]]
+		}
+		// the b-leg may hang up first, the call is forgotten with the a-leg
+		delete(h.recorded, id)
+		// the inbound leg is the one which ran the dialplan of the context
+		context := event["Caller-Context"]
+		if !recorded && event["Call-Direction"] == "inbound" && answered(event) && slices.Contains(h.contexts, context) {
+			h.missing.WithLabelValues(context).Inc()
+		}
+	}
+}
+
+// prune forgets the recordings started and the calls recorded more than
+// stateMaxAge before now, whose stop or hangup was missed.
+func (h *recordingsHandler) prune(now int64) {
+	if now-h.pruned < statePruneTime {
+		return
+	}
+	h.pruned = now
+	for key, running := range h.recordings {
+		if now-running.started > stateMaxAge {
+			delete(h.recordings, key)
+			h.active.WithLabelValues(running.profile).Dec()
+		}
+	}
+	for id, recorded := range h.recorded {
+		if now-recorded > stateMaxAge {
+			delete(h.recorded, id)
+		}
+	}
+}
+
+func (h *recordingsHandler) Describe(ch chan<- *prometheus.Desc) {
+	h.active.Describe(ch)
+	h.started.Describe(ch)
+	h.stopped.Describe(ch)
+	h.duration.Describe(ch)
+	h.missing.Describe(ch)
+}
+
+func (h *recordingsHandler) Collect(ch chan<- prometheus.Metric) {
+	h.active.Collect(ch)
+	h.started.Collect(ch)
+	h.stopped.Collect(ch)
+	h.duration.Collect(ch)
+	h.missing.Collect(ch)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dialReplay returns a connection to an in-process event socket which answers
+// commands with the responses recorded in dir, instead of a live FreeSWITCH.
+func dialReplay(dir string) (net.Conn, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("cannot replay: %w", err)
+	}
+
+	client, server := net.Pipe()
+	go serveReplay(server, dir)
+	return client, nil
+}
+
+func serveReplay(conn net.Conn, dir string) {
+	serveESL(conn, func(command string, _ textproto.MIMEHeader) ([]byte, bool) {
+		switch name, _, _ := strings.Cut(command, " "); name {
+		case "auth", "userauth":
+			return replyFrame("+OK accepted"), true
+		case "api":
+			return loadFixture(dir, command), true
+		}
+		return replyFrame("+OK"), true
+	})
+}
+
+// loadFixture returns the recorded frame answering command, as it was sent.
+func loadFixture(dir, command string) []byte {
+	raw, err := os.ReadFile(filepath.Join(dir, fixtureName(command)))
+	if err != nil {
+		return apiFrame(fmt.Sprintf("-ERR no recorded response for %s\n", command))
+	}
+	return raw
+}
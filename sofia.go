@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// registrationEvents are the custom events of sofia about registrations,
+// by the value of the event label.
+var registrationEvents = map[string]string{
+	"CUSTOM sofia::register":         "register",
+	"CUSTOM sofia::unregister":       "unregister",
+	"CUSTOM sofia::expire":           "expire",
+	"CUSTOM sofia::register_failure": "register_failure",
+}
+
+// registrationHandler counts the registration events, which keep happening
+// behind a stable number of registrations when phones flap.
+type registrationHandler struct {
+	events *prometheus.CounterVec
+}
+
+func newRegistrationHandler(_ *eventConfig) eventHandler {
+	return &registrationHandler{
+		events: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sofia_registration_events_total",
+			Help:      "Number of registrations, unregistrations, expired registrations and failed registrations.",
+		}, []string{"event", "profile", "realm", "proto"}),
+	}
+}
+
+func (h *registrationHandler) subscriptions() []string {
+	return []string{"CUSTOM sofia::register", "CUSTOM sofia::unregister", "CUSTOM sofia::expire", "CUSTOM sofia::register_failure"}
+}
+
+func (h *registrationHandler) handle(event eslEvent) {
+	h.events.WithLabelValues(registrationEvents[eventKey(event)], event["profile-name"], registrationRealm(event), registrationProto(event)).Inc()
+}
+
+func (h *registrationHandler) Describe(ch chan<- *prometheus.Desc) {
+	h.events.Describe(ch)
+}
+
+func (h *registrationHandler) Collect(ch chan<- prometheus.Metric) {
+	h.events.Collect(ch)
+}
+
+// registrationRealm returns the realm of a registration event. Only
+// sofia::register has one, the others have the host of the user.
+func registrationRealm(event eslEvent) string {
+	for _, header := range []string{"realm", "from-host", "to-host", "host"} {
+		if realm := event[header]; realm != "" {
+			return realm
+		}
+	}
+	return ""
+}
+
+// registrationProto returns the transport of a registration, which is that
+// of the contact: UDP unless it says otherwise.
+func registrationProto(event eslEvent) string {
+	if proto := event["network-proto"]; proto != "" {
+		return strings.ToLower(proto)
+	}
+	contact := strings.ToLower(event["contact"])
+	if contact == "" {
+		return ""
+	}
+	if _, params, ok := strings.Cut(contact, ";transport="); ok {
+		proto, _, _ := strings.Cut(params, ";")
+		return strings.TrimRight(proto, ">\" ")
+	}
+	if strings.HasPrefix(contact, "sips:") || strings.Contains(contact, "<sips:") {
+		return "tls"
+	}
+	return "udp"
+}
+
+// gatewayStateHandler counts the state transitions of the gateways, which are
+// missed by the sofiastatus collector when they happen between scrapes.
+type gatewayStateHandler struct {
+	transitions    *prometheus.CounterVec
+	lastTransition *prometheus.GaugeVec
+	// states are the last known states of the gateways, only used by handle
+	states map[string]string
+}
+
+func newGatewayStateHandler(_ *eventConfig) eventHandler {
+	return &gatewayStateHandler{
+		transitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sofia_gateway_transitions_total",
+			Help:      "Number of state transitions of the gateway, from is empty for the first state seen.",
+		}, []string{"gateway", "from", "to"}),
+		lastTransition: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "sofia_gateway_last_transition_timestamp_seconds",
+			Help:      "Time of the last state transition of the gateway, in seconds since the epoch.",
+		}, []string{"gateway"}),
+		states: make(map[string]string),
+	}
+}
+
+func (h *gatewayStateHandler) subscriptions() []string {
+	return []string{"CUSTOM sofia::gateway_state"}
+}
+
+func (h *gatewayStateHandler) handle(event eslEvent) {
+	gateway, state := event["Gateway"], event["State"]
+	if gateway == "" || state == "" {
+		return
+	}
+	// the event is also sent when only the ping status changes
+	from, ok := h.states[gateway]
+	if ok && from == state {
+		return
+	}
+	h.states[gateway] = state
+
+	h.transitions.WithLabelValues(gateway, from, state).Inc()
+	timestamp, err := strconv.ParseInt(event["Event-Date-Timestamp"], 10, 64)
+	if err != nil {
+		timestamp = time.Now().UnixMicro()
+	}
+	h.lastTransition.WithLabelValues(gateway).Set(float64(timestamp) / 1e6)
+}
+
+func (h *gatewayStateHandler) Describe(ch chan<- *prometheus.Desc) {
+	h.transitions.Describe(ch)
+	h.lastTransition.Describe(ch)
+}
+
+func (h *gatewayStateHandler) Collect(ch chan<- prometheus.Metric) {
+	h.transitions.Collect(ch)
+	h.lastTransition.Collect(ch)
+}